@@ -5,12 +5,16 @@
 package goftp
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,6 +43,13 @@ type ftpError struct {
 	msg       string
 	timeout   bool
 	temporary bool
+
+	// a listing's data connection failed partway through
+	interrupted bool
+
+	// the server doesn't advertise support for the command (see
+	// unsupportedError)
+	unsupported bool
 }
 
 func (e ftpError) Error() string {
@@ -49,6 +60,11 @@ func (e ftpError) Error() string {
 	}
 }
 
+// Unwrap returns the underlying error, if any.
+func (e ftpError) Unwrap() error {
+	return e.err
+}
+
 func (e ftpError) Temporary() bool {
 	return e.temporary || transientNegativeCompletionReply(e.code)
 }
@@ -71,6 +87,82 @@ func (e ftpError) Message() string {
 	return e.msg
 }
 
+// Error returned when the server doesn't advertise support for a command
+// (via "FEAT") that is required for an operation.
+func unsupportedError(command string) error {
+	return ftpError{
+		err:         fmt.Errorf("server doesn't support %s", command),
+		unsupported: true,
+	}
+}
+
+// DataConnError is returned when a data connection (used for transfers and
+// listings) couldn't be established, as opposed to a failed command on the
+// control connection. This often means a firewall or NAT is blocking the
+// data port, in which case a different Config.TransferMode may help.
+type DataConnError struct {
+	// The address dialed (passive mode) or listened on (active mode).
+	Addr string
+
+	// Whether this was an active mode connection, i.e. the server was
+	// supposed to connect to us.
+	Active bool
+
+	// The underlying error.
+	Err error
+}
+
+func (e DataConnError) Error() string {
+	if e.Active {
+		return fmt.Sprintf("error accepting active data connection on %s: %s", e.Addr, e.Err)
+	}
+	return fmt.Sprintf("error opening data connection to %s: %s", e.Addr, e.Err)
+}
+
+// Temporary reports whether the underlying error is temporary, such as a
+// timeout.
+func (e DataConnError) Temporary() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// Timeout reports whether the underlying error is a timeout.
+func (e DataConnError) Timeout() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Code always returns 0 since the error didn't come from the server.
+func (e DataConnError) Code() int {
+	return 0
+}
+
+// Message always returns "" since the error didn't come from the server.
+func (e DataConnError) Message() string {
+	return ""
+}
+
+// PathEncoding converts text between UTF-8 and a server's character set. The
+// encodings in golang.org/x/text/encoding are easily adapted, e.g.:
+//
+//	type gbk struct{}
+//
+//	func (gbk) Encode(s string) (string, error) { return simplifiedchinese.GBK.NewEncoder().String(s) }
+//	func (gbk) Decode(s string) (string, error) { return simplifiedchinese.GBK.NewDecoder().String(s) }
+type PathEncoding interface {
+	// Encode converts UTF-8 text to the server's encoding.
+	Encode(s string) (string, error)
+
+	// Decode converts text in the server's encoding to UTF-8.
+	Decode(s string) (string, error)
+}
+
+// StructuredLogger is the subset of *slog.Logger used for Config.Slog.
+type StructuredLogger interface {
+	// Debug logs msg at debug level with alternating key/value attributes.
+	Debug(msg string, args ...interface{})
+}
+
 // TLSMode represents the FTPS connection strategy. Servers cannot support
 // both modes on the same port.
 type TLSMode int
@@ -85,10 +177,43 @@ const (
 	TLSImplicit TLSMode = 1
 )
 
-// for testing
-type stubResponse struct {
-	code int
-	msg  string
+// TransferMode represents how data connections are established.
+type TransferMode int
+
+const (
+	// PassiveOnly means the client connects to the server for data
+	// connections ("EPSV"/"PASV").
+	PassiveOnly TransferMode = iota
+
+	// ActiveOnly means the server connects to the client for data connections
+	// ("EPRT"/"PORT").
+	ActiveOnly
+
+	// PassivePreferred tries passive mode first, falling back to active mode.
+	PassivePreferred
+
+	// ActivePreferred tries active mode first, falling back to passive mode.
+	ActivePreferred
+)
+
+// TransferType represents the representation type ("TYPE") used for file
+// transfers.
+type TransferType string
+
+const (
+	// TransferBinary transfers files byte for byte ("TYPE I").
+	TransferBinary TransferType = "I"
+
+	// TransferASCII has the server translate line endings of text files
+	// ("TYPE A"). Failed ASCII transfers aren't resumed, and transferred sizes
+	// aren't verified, since they needn't match the file's size.
+	TransferASCII TransferType = "A"
+)
+
+// StubResponse is a canned server reply used by Config.ResponseOverrides.
+type StubResponse struct {
+	Code    int
+	Message string
 }
 
 // Config contains configuration for a Client object.
@@ -99,20 +224,90 @@ type Config struct {
 	// User password. Defaults to "anonymous" if required.
 	Password string
 
+	// Account information, sent with "ACCT" if the server asks for it
+	// (reply 332) after USER or PASS. Some mainframe servers require it.
+	Account string
+
 	// Maximum number of FTP connections to open per-host. Defaults to 5. Keep in
 	// mind that FTP servers typically limit how many connections a single user
 	// may have open at once, so you may need to lower this if you are doing
 	// concurrent transfers.
 	ConnectionsPerHost int
 
+	// How long to wait for a connection to become free when all
+	// ConnectionsPerHost connections are in use. Operations that time out
+	// waiting fail with a temporary Error. Defaults to 0 (wait forever).
+	PoolWaitTimeout time.Duration
+
 	// Timeout for opening connections, sending control commands, and each read/write
-	// of data transfers. Defaults to 5 seconds.
+	// of data transfers (unless DataTimeout is set). Defaults to 5 seconds.
 	Timeout time.Duration
 
+	// Timeout for opening data connections and each read/write of data transfers.
+	// Defaults to Timeout.
+	DataTimeout time.Duration
+
+	// If set, send "NOOP" on the control connection at this interval while a
+	// Retrieve, Store or Append transfer is in progress, to stop servers or
+	// firewalls from dropping the idle control connection during long
+	// transfers. Defaults to 0 (disabled).
+	ControlKeepAlive time.Duration
+
+	// Maximum number of lines in a single (multi-line) control connection
+	// response. A server whose response exceeds this is treated as
+	// misbehaving and the connection is closed, rather than waiting for
+	// Timeout on a response that may never be terminated. Defaults to 0 (no
+	// limit). Note that "STAT" listings (see StatList) arrive as a single
+	// response.
+	MaxResponseLines int
+
+	// Maximum size in bytes of a single control connection response, handled
+	// like MaxResponseLines. Defaults to 0 (no limit).
+	MaxResponseSize int
+
+	// Function used to open control connections and passive data connections,
+	// e.g. to bind to a particular local address or to dial through a proxy.
+	// The context passed is canceled after Timeout (or DataTimeout for data
+	// connections). Defaults to net.DialTimeout.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Function used to dial through a proxy (e.g. the Dial method of a
+	// golang.org/x/net/proxy SOCKS5 Dialer) for control connections and
+	// passive data connections. Takes precedence over DialContext. Timeouts
+	// while dialing are left to the proxy dialer. Since the proxy must be able
+	// to reach the address the server advertises for passive connections,
+	// consider setting IgnorePASVAddress. Active transfers require the server
+	// to connect back to the client, which generally can't be proxied.
+	Proxy func(network, addr string) (net.Conn, error)
+
+	// Local address to bind control connections and passive data connections
+	// to, e.g. &net.TCPAddr{IP: net.ParseIP("192.0.2.1")} to choose the source
+	// address on a multi-homed host. Ignored if DialContext or Proxy is set.
+	// Does not affect active data connections (see ActiveListenAddr).
+	LocalAddr net.Addr
+
 	// TLS Config used for FTPS. If provided, it will be an error if the server
 	// does not support TLS. Both the control and data connection will use TLS.
 	TLSConfig *tls.Config
 
+	// TLS Config used for data connections, if different from TLSConfig (e.g.
+	// to set a different ServerName). Only used if TLSConfig is set. Defaults
+	// to TLSConfig.
+	DataTLSConfig *tls.Config
+
+	// Resume the control connection's TLS session when opening passive data
+	// connections, as required by some servers (e.g. vsftpd with
+	// require_ssl_reuse=YES). Each control connection gets its own
+	// ClientSessionCache, and ServerName defaults to the server's host since
+	// it is used as the session cache key. Only used if TLSConfig is set.
+	TLSSessionReuse bool
+
+	// Send "PROT C" instead of "PROT P" after logging in with TLS, so only the
+	// control connection is encrypted and data connections are left in the
+	// clear. This speeds up large transfers of non-sensitive data. Only used
+	// if TLSConfig is set.
+	ClearDataChannel bool
+
 	// FTPS mode. TLSExplicit means connect non-TLS, then upgrade connection to
 	// TLS via "AUTH TLS" command. TLSImplicit means open the connection using
 	// TLS. Defaults to TLSExplicit.
@@ -129,34 +324,186 @@ type Config struct {
 	// Password value will not be logged.
 	Logger io.Writer
 
+	// Structured logging destination for debugging messages, typically a
+	// *slog.Logger. Messages are logged at debug level with attributes such
+	// as the connection index, and each control command is logged with its
+	// response code and duration. Password value will not be logged. May be
+	// used alongside Logger.
+	Slog StructuredLogger
+
 	// Time zone of the FTP server. Used when parsing mtime from "LIST" output if
 	// server does not support "MLST"/"MLSD". Defaults to UTC.
 	ServerLocation *time.Location
 
+	// By default, "MLST"/"MLSD" entries without a "modify" fact (as some
+	// servers send for sockets or devices) get a zero ModTime. Set
+	// StrictMLST to instead fail with an error, as goftp used to.
+	StrictMLST bool
+
 	// Enable "active" FTP data connections where the server connects to the client to
 	// establish data connections (does not work if client is behind NAT). If TLSConfig
-	// is specified, it will be used when listening for active connections.
+	// is specified, it will be used when listening for active connections. Equivalent
+	// to setting TransferMode to ActiveOnly.
 	ActiveTransfers bool
 
+	// How data connections are established. PassivePreferred and ActivePreferred
+	// fall back to the other mode if the preferred mode fails, and then stick with
+	// the other mode for the rest of the control connection's life. Note that a
+	// failed active connection can only be detected if the server rejects the
+	// "PORT"/"EPRT" command, not if the server fails to connect. Defaults to
+	// PassiveOnly (or ActiveOnly if ActiveTransfers is set).
+	TransferMode TransferMode
+
 	// Set the host:port to listen on for active data connections. If the host and/or
 	// port is empty, the local address/port of the control connection will be used. A
 	// port of 0 will listen on a random port. If not specified, the default behavior is
 	// ":0", i.e. listen on the local control connection host and a random port.
 	ActiveListenAddr string
 
+	// Range of ports (inclusive) to choose from when listening for active data
+	// connections, e.g. [2]int{50000, 50100}. Each data connection listens on a
+	// free port from the range, which is useful for opening a predictable
+	// firewall window. When set, the port in ActiveListenAddr is ignored.
+	ActivePortRange [2]int
+
 	// Disables EPSV in favour of PASV. This is useful in cases where EPSV connections
 	// neither complete nor downgrade to PASV successfully by themselves, resulting in
-	// hung connections.
+	// hung connections. Even when EPSV is enabled, a connection stops using it
+	// once EPSV is rejected or its data connection fails.
 	DisableEPSV bool
 
-	// For testing convenience.
-	stubResponses map[string]stubResponse
+	// Transfer type used by Retrieve, Store and Append. RetrieveASCII and
+	// StoreASCII can be used for one-off ASCII transfers. Defaults to
+	// TransferBinary.
+	DefaultTransferType TransferType
+
+	// Ignore the IP address the server advertises in its PASV reply and
+	// connect to the control connection's remote address instead (using the
+	// advertised port). This helps with servers behind NAT that advertise an
+	// internal, unreachable address. EPSV replies never contain an address.
+	IgnorePASVAddress bool
+
+	// Called with the address (host:port) from each EPSV or PASV reply and
+	// the control connection's remote address, returning the address to
+	// connect to for the data connection. Useful when going through proxies
+	// or NAT where neither address is reachable as is. EPSV replies don't
+	// contain a host, so the reported address uses the control connection's
+	// host. Takes precedence over IgnorePASVAddress.
+	RewritePassiveAddr func(reported, control string) string
+
+	// By default, if the server advertises UTF8 support, "OPTS UTF8 ON" is sent
+	// after logging in so non-ASCII paths are handled as UTF-8. Set DisableUTF8
+	// for servers that misbehave when asked to do so.
+	DisableUTF8 bool
+
+	// Character encoding used by the server for paths, for servers that don't use
+	// UTF-8 (e.g. GBK or Latin-1). Commands are encoded before being sent, and
+	// responses and listings are decoded as they are received. Defaults to nil,
+	// which leaves paths as raw bytes.
+	PathEncoding PathEncoding
+
+	// Virtual host name to select with the "HOST" command (RFC 7151) before
+	// logging in, for servers hosting multiple domains on one address. Servers
+	// that don't support "HOST" are tolerated.
+	Host string
+
+	// If set, and the server advertises the "CLNT" feature, "CLNT <ClientName>"
+	// is sent after logging in to identify the client to the server.
+	ClientName string
+
+	// Close pooled connections that have been idle for longer than this instead of
+	// reusing them, since servers often drop idle control connections. A new
+	// connection is opened in their place. Defaults to 0 (no limit).
+	IdleTimeout time.Duration
+
+	// Send a "NOOP" on pooled connections before reusing them. Connections that
+	// fail the "NOOP" are transparently replaced with a new connection.
+	TestOnBorrow bool
+
+	// Called after each command sent on a control connection with the command
+	// (with any password redacted) and the server's response. If the command
+	// couldn't be sent or the response couldn't be read, code is 0 and msg is
+	// the error. The hook is invoked from the goroutine sending the command, so
+	// it may be called concurrently.
+	CommandHook func(sent string, code int, msg string)
+
+	// Record the most recent commands sent on pooled connections along with
+	// the server's responses (including success messages), retrievable via
+	// Client.RecentResponses. Useful for diagnostics.
+	CaptureResponses bool
+
+	// Called periodically during Retrieve and Store with the cumulative number of
+	// bytes transferred so far, including bytes transferred before any resumed
+	// attempts. totalBytes is the expected size of the file, or -1 if unknown
+	// (e.g. the server doesn't support SIZE, or the upload source isn't an
+	// io.Seeker). The callback is invoked from the goroutine doing the transfer.
+	ProgressCallback func(path string, bytesTransferred, totalBytes int64)
+
+	// Size in bytes of the buffer used to copy data during transfers.
+	// Defaults to 0, which uses io.Copy's default (32KB). Larger buffers,
+	// e.g. 1MB, can improve throughput on high bandwidth, high latency
+	// links. Each transfer allocates its own buffer. The buffer isn't used
+	// when the source is an io.WriterTo (e.g. *bytes.Reader) or the
+	// destination an io.ReaderFrom (e.g. *os.File), since they copy
+	// directly.
+	TransferBufferSize int
+
+	// Called with each new control connection right after it is
+	// established (before any TLS handshake), e.g. to tune socket options.
+	// The connection is usually a *net.TCPConn. If the callback returns an
+	// error, the connection is closed and the error returned.
+	ControlConnCallback func(net.Conn) error
+
+	// Like ControlConnCallback, but called with each new data connection
+	// (before any TLS handshake), e.g. to set larger socket buffers.
+	DataConnCallback func(net.Conn) error
+
+	// After Retrieve (or RetrieveFrom with a zero offset) succeeds in binary
+	// mode, ask the server for the file's checksum (see Client.Hash) and
+	// compare it against the bytes written. The strongest algorithm the
+	// server supports is used; verification is skipped if it supports none.
+	// This catches corruption that the SIZE check can't.
+	VerifyChecksum bool
+
+	// Open (and log in on) one connection in DialConfig, returning an error
+	// if that fails. By default no connections are opened until the first
+	// operation, so connectivity and authentication errors aren't surfaced
+	// until then.
+	EagerConnect bool
+
+	// Number of times to retry an operation that fails with a temporary
+	// error (see Error.Temporary), such as a timeout or a 421, 425 or 426
+	// reply. Connections that encounter an unrecoverable error are discarded,
+	// so retries use a fresh connection. Retried operations include Delete,
+	// Rename, Mkdir, Rmdir, Stat, ReadDir and List, as well as Retrieve and
+	// Store when no bytes have been transferred (Store additionally requires
+	// an io.Seeker). Defaults to 0 (no retries).
+	MaxRetries int
+
+	// How long to wait before the first retry. The wait doubles after each
+	// subsequent attempt.
+	RetryBackoff time.Duration
+
+	// Number of times to restart a listing (ReadDir, List, etc.) whose data
+	// connection fails partway through, e.g. while reading a huge directory.
+	// Listings can't be resumed, so each restart fetches the whole listing
+	// again on a fresh connection. These restarts are in addition to
+	// MaxRetries. Defaults to 0 (no restarts). ReadDirStream is never
+	// restarted.
+	ListingRetries int
+
+	// Replies to return for specific commands without sending them to the
+	// server, keyed by the exact command line (e.g. "EPSV" or "DELE foo").
+	// Intended for testing how the client copes with unusual server
+	// behavior.
+	ResponseOverrides map[string]StubResponse
 }
 
 // Client maintains a connection pool to the FTP server(s), so you typically only
 // need one Client object. Client methods are safe to call concurrently from
 // different goroutines, but once you are using all ConnectionsPerHost connections
-// per host, methods will block waiting for a free connection.
+// per host, methods will block waiting for a free connection (see
+// Config.PoolWaitTimeout).
 type Client struct {
 	config          Config
 	hosts           []string
@@ -168,6 +515,151 @@ type Client struct {
 	mu              sync.Mutex
 	t0              time.Time
 	closed          bool
+
+	// working directory set via ChangeDir (empty if never changed)
+	cwd string
+
+	// cached "SYST" response
+	system string
+
+	// counters reported by Stats (updated atomically)
+	stats *clientStats
+
+	// recent command/response pairs, if Config.CaptureResponses is set
+	responses *responseLog
+
+	// incremented by Reinitialize, so connections logged in with old
+	// credentials can be recognized
+	credGen int
+
+	// set by DialWithConn: the only control connection is givenConn, which
+	// is nil once it has been used
+	singleConn bool
+	givenConn  net.Conn
+}
+
+// Number of command/response pairs kept when Config.CaptureResponses is set.
+const maxRecentResponses = 50
+
+// CommandResponse is a command sent to the server along with the server's
+// response, as recorded when Config.CaptureResponses is set.
+type CommandResponse struct {
+	// The command sent, with any password redacted.
+	Command string
+
+	// The response code, or 0 if the command couldn't be sent or the
+	// response couldn't be read.
+	Code int
+
+	// The response message, or the error if Code is 0.
+	Message string
+}
+
+// Ring buffer of the most recent command/response pairs.
+type responseLog struct {
+	mu      sync.Mutex
+	entries []CommandResponse
+	next    int
+}
+
+func (l *responseLog) add(r CommandResponse) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) < maxRecentResponses {
+		l.entries = append(l.entries, r)
+		return
+	}
+
+	l.entries[l.next] = r
+	l.next = (l.next + 1) % maxRecentResponses
+}
+
+func (l *responseLog) recent() []CommandResponse {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ret := make([]CommandResponse, 0, len(l.entries))
+	ret = append(ret, l.entries[l.next:]...)
+	return append(ret, l.entries[:l.next]...)
+}
+
+// RecentResponses returns the most recent commands sent on the Client's
+// pooled connections along with the server's responses, oldest first. It
+// returns nil unless Config.CaptureResponses is set.
+func (c *Client) RecentResponses() []CommandResponse {
+	if c.responses == nil {
+		return nil
+	}
+
+	return c.responses.recent()
+}
+
+// Cumulative counters backing ClientStats.
+type clientStats struct {
+	connsOpened      int64
+	commandsSent     int64
+	bytesTransferred int64
+	retries          int64
+	reconnects       int64
+}
+
+// ClientStats is a snapshot of a Client's activity, as returned by
+// Client.Stats.
+type ClientStats struct {
+	// Number of pooled connections currently open, idle or in use.
+	OpenConns int
+
+	// Number of open connections currently idle in the pool.
+	IdleConns int
+
+	// Total number of pooled connections opened.
+	ConnsOpened int64
+
+	// Total number of control commands sent, including commands sent on
+	// RawConns.
+	CommandsSent int64
+
+	// Total number of bytes transferred over data connections by Retrieve,
+	// Store and similar methods. Listings are not counted.
+	BytesTransferred int64
+
+	// Total number of times an operation was retried (see Config.MaxRetries).
+	Retries int64
+
+	// Total number of times a broken control connection was reopened to
+	// replay an idempotent command such as "PWD" or "SIZE".
+	Reconnects int64
+}
+
+// Stats returns a snapshot of the Client's connection pool and activity
+// counters.
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		OpenConns:        c.NumOpenConns(),
+		IdleConns:        c.NumIdleConns(),
+		ConnsOpened:      atomic.LoadInt64(&c.stats.connsOpened),
+		CommandsSent:     atomic.LoadInt64(&c.stats.commandsSent),
+		BytesTransferred: atomic.LoadInt64(&c.stats.bytesTransferred),
+		Retries:          atomic.LoadInt64(&c.stats.retries),
+		Reconnects:       atomic.LoadInt64(&c.stats.reconnects),
+	}
+}
+
+// NumOpenConns returns the number of pooled connections currently open,
+// whether idle or in use.
+func (c *Client) NumOpenConns() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.numOpenConns()
+}
+
+// NumIdleConns returns the number of open connections currently idle in the
+// pool. If it stays at 0 while NumOpenConns is at the pool's limit, callers
+// are waiting for connections and ConnectionsPerHost may be too low.
+func (c *Client) NumIdleConns() int {
+	return len(c.freeConnCh)
 }
 
 // Construct and return a new client Conn, setting default config
@@ -182,6 +674,18 @@ func newClient(config Config, hosts []string) *Client {
 		config.Timeout = 5 * time.Second
 	}
 
+	if config.DataTimeout <= 0 {
+		config.DataTimeout = config.Timeout
+	}
+
+	if config.ActiveTransfers && config.TransferMode == PassiveOnly {
+		config.TransferMode = ActiveOnly
+	}
+
+	if config.DefaultTransferType == "" {
+		config.DefaultTransferType = TransferBinary
+	}
+
 	if config.User == "" {
 		config.User = "anonymous"
 	}
@@ -198,19 +702,27 @@ func newClient(config Config, hosts []string) *Client {
 		config.ActiveListenAddr = ":0"
 	}
 
-	return &Client{
+	client := &Client{
 		config:          config,
 		freeConnCh:      make(chan *persistentConn, len(hosts)*config.ConnectionsPerHost),
 		t0:              time.Now(),
 		hosts:           hosts,
 		allCons:         make(map[int]*persistentConn),
 		numConnsPerHost: make(map[string]int),
+		stats:           &clientStats{},
+	}
+
+	if config.CaptureResponses {
+		client.responses = &responseLog{}
 	}
+
+	return client
 }
 
-// Close closes all open server connections. Currently this does not attempt
-// to do any kind of polite FTP connection termination. It will interrupt
-// all transfers in progress.
+// Close closes all open server connections. Idle connections are closed
+// politely by sending "QUIT" (waiting up to Timeout for the server's reply)
+// so the server doesn't see an abrupt disconnect. Connections in use are
+// closed immediately, interrupting any transfers in progress.
 func (c *Client) Close() error {
 	c.mu.Lock()
 	if c.closed {
@@ -225,6 +737,22 @@ func (c *Client) Close() error {
 	}
 	c.mu.Unlock()
 
+	var wg sync.WaitGroup
+Loop:
+	for {
+		select {
+		case pconn := <-c.freeConnCh:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pconn.quit()
+			}()
+		default:
+			break Loop
+		}
+	}
+	wg.Wait()
+
 	for _, pconn := range conns {
 		c.removeConn(pconn)
 	}
@@ -232,9 +760,106 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// Reinitialize changes the credentials the Client logs in with, e.g. after
+// a password rotation. Idle connections are reset with "REIN" and logged
+// in again as user. Connections that can't be reset that way (the server
+// doesn't support REIN, or the connection uses TLS) are closed, as are
+// connections that are busy once they are returned to the pool, so later
+// operations open new connections with the new credentials. An error is
+// returned if logging in with the new credentials fails.
+func (c *Client) Reinitialize(user, password string) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ftpError{err: errors.New("client closed")}
+	}
+	c.config.User = user
+	c.config.Password = password
+	c.credGen++
+	credGen := c.credGen
+	c.mu.Unlock()
+
+	var idle []*persistentConn
+Loop:
+	for {
+		select {
+		case pconn := <-c.freeConnCh:
+			idle = append(idle, pconn)
+		default:
+			break Loop
+		}
+	}
+
+	var firstErr error
+	for _, pconn := range idle {
+		reset, err := c.reinitConn(pconn, user, password)
+		if err != nil {
+			pconn.debug("error reinitializing: %s", err)
+			if reset && firstErr == nil {
+				firstErr = err
+			}
+			c.discardConn(pconn)
+			continue
+		}
+
+		pconn.credGen = credGen
+		c.returnConn(pconn)
+	}
+
+	return firstErr
+}
+
+// Send "REIN" on pconn and log in again with user and password. reset
+// reports whether the server accepted the REIN.
+func (c *Client) reinitConn(pconn *persistentConn, user, password string) (reset bool, err error) {
+	if pconn.config.TLSConfig != nil {
+		// TLS state after REIN varies by server; start over instead
+		return false, ftpError{err: errors.New("not reinitializing TLS connection")}
+	}
+
+	code, msg, err := pconn.sendCommand("REIN")
+	if err == nil && code == replyReadyInNMinutes {
+		code, msg, err = pconn.readResponse()
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if code != replyServiceReady {
+		return false, ftpError{code: code, msg: msg}
+	}
+
+	// REIN resets everything but the control connection
+	pconn.config.User = user
+	pconn.config.Password = password
+	pconn.currentType = "A"
+	pconn.cwd = ""
+
+	if pconn.config.Host != "" {
+		if err := pconn.sendHost(); err != nil {
+			return true, err
+		}
+	}
+
+	if err := pconn.logIn(); err != nil {
+		return true, err
+	}
+
+	if err := c.sendOptions(pconn); err != nil {
+		return true, err
+	}
+
+	return true, c.syncCwd(pconn)
+}
+
 // Log a debug message in the context of the client (i.e. not for a
 // particular connection).
 func (c *Client) debug(f string, args ...interface{}) {
+	if c.config.Slog != nil {
+		c.config.Slog.Debug(fmt.Sprintf(f, args...))
+	}
+
 	if c.config.Logger == nil {
 		return
 	}
@@ -255,20 +880,48 @@ func (c *Client) numOpenConns() int {
 
 // Get an idle connection.
 func (c *Client) getIdleConn() (*persistentConn, error) {
+	pconn, err := c.nextConn()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.syncCwd(pconn); err != nil {
+		c.returnConn(pconn)
+		return nil, err
+	}
+
+	return pconn, nil
+}
+
+// Set pconn's working directory to the Client's working directory if
+// ChangeDir has changed it since pconn last used it.
+func (c *Client) syncCwd(pconn *persistentConn) error {
+	c.mu.Lock()
+	cwd := c.cwd
+	c.mu.Unlock()
+
+	if cwd == pconn.cwd {
+		return nil
+	}
+
+	if err := pconn.sendCommandExpected(replyFileActionOkay, "CWD %s", cwd); err != nil {
+		return err
+	}
+
+	pconn.cwd = cwd
+
+	return nil
+}
+
+func (c *Client) nextConn() (*persistentConn, error) {
 
 	// First check for available connections in the channel.
 Loop:
 	for {
 		select {
 		case pconn := <-c.freeConnCh:
-			if pconn.broken {
-				c.debug("#%d was ready (broken)", pconn.idx)
-				c.mu.Lock()
-				c.numConnsPerHost[pconn.host]--
-				c.mu.Unlock()
-				c.removeConn(pconn)
-			} else {
-				c.debug("#%d was ready", pconn.idx)
+			c.debug("#%d was ready", pconn.idx)
+			if c.checkPooledConn(pconn) {
 				return pconn, nil
 			}
 		default:
@@ -276,29 +929,20 @@ Loop:
 		}
 	}
 
+	// fires if we wait longer than PoolWaitTimeout for a free connection
+	var waitTimeout <-chan time.Time
+
 	// No available connections. Loop until we can open a new one, or
 	// one becomes available.
 	for {
 		c.mu.Lock()
 
-		// can we open a connection to some host
-		if c.numOpenConns() < len(c.hosts)*c.config.ConnectionsPerHost {
+		// can we open a connection to some host without exceeding its
+		// ConnectionsPerHost
+		if host := c.pickHost(c.connIdx + 1); host != "" {
 			c.connIdx++
 			idx := c.connIdx
 
-			// find the next host with less than ConnectionsPerHost connections
-			var host string
-			for i := idx; i < idx+len(c.hosts); i++ {
-				if c.numConnsPerHost[c.hosts[i%len(c.hosts)]] < c.config.ConnectionsPerHost {
-					host = c.hosts[i%len(c.hosts)]
-					break
-				}
-			}
-
-			if host == "" {
-				panic("this shouldn't be possible")
-			}
-
 			c.numConnsPerHost[host]++
 
 			c.mu.Unlock()
@@ -309,27 +953,94 @@ Loop:
 				c.numConnsPerHost[host]--
 				c.mu.Unlock()
 				c.debug("#%d error connecting: %s", idx, err)
+			} else {
+				atomic.AddInt64(&c.stats.connsOpened, 1)
 			}
 			return pconn, err
 		}
 
 		c.mu.Unlock()
 
+		if waitTimeout == nil && c.config.PoolWaitTimeout > 0 {
+			timer := time.NewTimer(c.config.PoolWaitTimeout)
+			defer timer.Stop()
+			waitTimeout = timer.C
+		}
+
 		// block waiting for a free connection
-		pconn := <-c.freeConnCh
+		var pconn *persistentConn
+		select {
+		case pconn = <-c.freeConnCh:
+		case <-waitTimeout:
+			return nil, ftpError{
+				err:       fmt.Errorf("timed out after %s waiting for a free connection", c.config.PoolWaitTimeout),
+				temporary: true,
+				timeout:   true,
+			}
+		}
 
-		if pconn.broken {
-			c.debug("waited and got #%d (broken)", pconn.idx)
-			c.mu.Lock()
-			c.numConnsPerHost[pconn.host]--
-			c.mu.Unlock()
-			c.removeConn(pconn)
-		} else {
-			c.debug("waited and got #%d", pconn.idx)
+		c.debug("waited and got #%d", pconn.idx)
+		if c.checkPooledConn(pconn) {
 			return pconn, nil
+		}
+	}
+}
+
+// Pick the host with the fewest open connections (below ConnectionsPerHost)
+// to open a new connection to, breaking ties round-robin starting from
+// hosts[idx]. Returns "" if every host is at its limit. c.mu must be held.
+func (c *Client) pickHost(idx int) string {
+	var (
+		host     string
+		minConns = c.config.ConnectionsPerHost
+	)
+
+	for i := idx; i < idx+len(c.hosts); i++ {
+		candidate := c.hosts[i%len(c.hosts)]
+		if numConns := c.numConnsPerHost[candidate]; numConns < minConns {
+			host = candidate
+			minConns = numConns
+		}
+	}
+
+	return host
+}
+
+// Check whether a connection taken from the pool is fit to be reused. Unfit
+// connections are discarded.
+func (c *Client) checkPooledConn(pconn *persistentConn) bool {
+	c.mu.Lock()
+	credGen := c.credGen
+	c.mu.Unlock()
 
+	var reason string
+	if pconn.broken {
+		reason = "broken"
+	} else if pconn.credGen != credGen {
+		reason = "logged in with old credentials"
+	} else if c.config.IdleTimeout > 0 && time.Since(pconn.lastUsed) > c.config.IdleTimeout {
+		reason = "idle too long"
+	} else if c.config.TestOnBorrow {
+		if err := pconn.sendCommandExpected(replyCommandOkay, "NOOP"); err != nil {
+			reason = fmt.Sprintf("NOOP failed: %s", err)
 		}
 	}
+
+	if reason == "" {
+		return true
+	}
+
+	pconn.debug("discarding pooled connection (%s)", reason)
+	c.discardConn(pconn)
+	return false
+}
+
+// Remove a pooled connection that can't be reused, freeing up its slot.
+func (c *Client) discardConn(pconn *persistentConn) {
+	c.mu.Lock()
+	c.numConnsPerHost[pconn.host]--
+	c.mu.Unlock()
+	c.removeConn(pconn)
 }
 
 func (c *Client) removeConn(pconn *persistentConn) {
@@ -340,12 +1051,215 @@ func (c *Client) removeConn(pconn *persistentConn) {
 }
 
 func (c *Client) returnConn(pconn *persistentConn) {
+	pconn.lastUsed = time.Now()
 	c.freeConnCh <- pconn
 }
 
+// Call f, retrying per MaxRetries and RetryBackoff while it returns a
+// temporary error.
+func (c *Client) retry(f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if !c.shouldRetry(attempt, err) {
+			return err
+		}
+	}
+}
+
+// Report whether an operation that failed with err on attempt number
+// "attempt" (starting from 0) should be retried, sleeping for the backoff
+// period first if so.
+func (c *Client) shouldRetry(attempt int, err error) bool {
+	if err == nil || attempt >= c.config.MaxRetries {
+		return false
+	}
+
+	if fe, ok := err.(Error); !ok || !fe.Temporary() {
+		return false
+	}
+
+	atomic.AddInt64(&c.stats.retries, 1)
+
+	backoff := c.config.RetryBackoff << uint(attempt)
+	c.debug("retrying in %s after temporary error (attempt %d of %d): %s", backoff, attempt+1, c.config.MaxRetries, err)
+	time.Sleep(backoff)
+
+	return true
+}
+
+// Noop sends a "NOOP" command to the server. This can be used to verify the
+// server is reachable and the configured credentials are accepted.
+func (c *Client) Noop() error {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return err
+	}
+
+	defer c.returnConn(pconn)
+
+	return pconn.sendCommandExpected(replyCommandOkay, "NOOP")
+}
+
+// SendCommand sends control command fmt.Sprintf(format, args...) on a
+// pooled connection and returns the server's raw response code and
+// message. It must not be used for commands that involve a data connection
+// (use OpenRawConn for those), or that change the connection's state in ways
+// the Client doesn't expect (e.g. "CWD", see ChangeDir).
+func (c *Client) SendCommand(format string, args ...interface{}) (int, string, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer c.returnConn(pconn)
+
+	return pconn.sendCommand(format, args...)
+}
+
+// System returns the server's response to the "SYST" command, e.g. "UNIX
+// Type: L8" or "Windows_NT". The response is cached after the first
+// successful call.
+func (c *Client) System() (string, error) {
+	c.mu.Lock()
+	system := c.system
+	c.mu.Unlock()
+
+	if system != "" {
+		return system, nil
+	}
+
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return "", err
+	}
+
+	defer c.returnConn(pconn)
+
+	code, msg, err := pconn.sendCommand("SYST")
+	if err != nil {
+		return "", err
+	}
+
+	if code != replySystemType {
+		return "", ftpError{code: code, msg: msg}
+	}
+
+	c.mu.Lock()
+	c.system = msg
+	c.mu.Unlock()
+
+	return msg, nil
+}
+
+// Site sends "SITE <args>" to the server and returns the server's raw
+// response code and message. SITE commands are server specific (e.g.
+// "SITE CHMOD 644 file" or "SITE UMASK 022"), so no attempt is made to
+// interpret the response.
+func (c *Client) Site(args string) (int, string, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer c.returnConn(pconn)
+
+	return pconn.sendCommand("SITE %s", args)
+}
+
+// Allocate sends "ALLO <size>" to reserve space on the server for a file of
+// "size" bytes before uploading it. Some servers use this to check the
+// upload fits within the user's quota. Servers that don't need space
+// reserved reply 202, which is treated as success. An Error is returned if
+// the server refuses.
+func (c *Client) Allocate(size int64) error {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return err
+	}
+
+	defer c.returnConn(pconn)
+
+	code, msg, err := pconn.sendCommand("ALLO %d", size)
+	if err != nil {
+		return err
+	}
+
+	if code != replyCommandOkay && code != replyCommandOkayNotImplemented {
+		return ftpError{code: code, msg: msg}
+	}
+
+	return nil
+}
+
+// Available returns the number of bytes available for uploads to directory
+// "path" (or the current directory if "path" is empty) using the "AVBL"
+// command. The server must advertise "AVBL" support.
+func (c *Client) Available(path string) (int64, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return -1, err
+	}
+
+	defer c.returnConn(pconn)
+
+	if !pconn.hasFeature("AVBL") {
+		return -1, unsupportedError("AVBL")
+	}
+
+	var (
+		code int
+		msg  string
+	)
+	if path == "" {
+		code, msg, err = pconn.sendCommand("AVBL")
+	} else {
+		code, msg, err = pconn.sendCommand("AVBL %s", path)
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	if code != replyFileStatus {
+		return -1, ftpError{code: code, msg: msg}
+	}
+
+	fields := strings.Fields(msg)
+	if len(fields) == 0 {
+		return -1, ftpError{err: fmt.Errorf("failed parsing AVBL response: %s", msg)}
+	}
+
+	avail, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return -1, ftpError{err: fmt.Errorf("failed parsing AVBL response: %s", msg)}
+	}
+
+	return avail, nil
+}
+
+// Features returns a copy of the features the server advertised in response
+// to the "FEAT" command, keyed by upper-cased feature name (e.g. "MLST",
+// "REST"). The value is the feature's parameter string, if any. The map is
+// empty if the server doesn't support FEAT.
+func (c *Client) Features() (map[string]string, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.returnConn(pconn)
+
+	features := make(map[string]string, len(pconn.features))
+	for name, val := range pconn.features {
+		features[name] = val
+	}
+
+	return features, nil
+}
+
 // OpenRawConn opens a "raw" connection to the server which allows you to run any control
 // or data command you want. See the RawConn interface for more details. The RawConn will
 // not participate in the Client's pool (i.e. does not count against ConnectionsPerHost).
+// The RawConn starts out in the Client's working directory (see ChangeDir).
 func (c *Client) OpenRawConn() (RawConn, error) {
 	c.mu.Lock()
 	idx := c.rawConnIdx
@@ -357,27 +1271,81 @@ func (c *Client) OpenRawConn() (RawConn, error) {
 
 // Open and set up a control connection.
 func (c *Client) openConn(idx int, host string) (pconn *persistentConn, err error) {
+	// User and Password may be changed by Reinitialize
+	c.mu.Lock()
+	config, credGen := c.config, c.credGen
+	c.mu.Unlock()
+
 	pconn = &persistentConn{
 		idx:              idx,
 		features:         make(map[string]string),
-		config:           c.config,
+		config:           config,
+		credGen:          credGen,
 		t0:               c.t0,
 		currentType:      "A",
 		host:             host,
 		epsvNotSupported: c.config.DisableEPSV,
+		stats:            c.stats,
+		responses:        c.responses,
+	}
+
+	if err := c.connect(pconn); err != nil {
+		return nil, err
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		pconn.close()
+		return nil, ftpError{err: errors.New("client closed")}
+	}
+
+	if idx >= 0 {
+		c.allCons[idx] = pconn
+
+		// raw connections (and the connection passed to DialWithConn) are
+		// never reopened behind the caller's back
+		if !c.singleConn {
+			pconn.reconnect = func() error { return c.reconnect(pconn) }
+		}
+	}
+
+	return pconn, nil
+}
+
+// Dial pconn's control connection, log in and set up the connection's
+// options and working directory.
+func (c *Client) connect(pconn *persistentConn) (err error) {
+	host := pconn.host
+
 	var conn net.Conn
 
+	if c.config.TLSConfig != nil && c.config.TLSSessionReuse {
+		pconn.enableTLSSessionReuse()
+	}
+
 	if c.config.TLSConfig != nil && c.config.TLSMode == TLSImplicit {
 		pconn.debug("opening TLS control connection to %s", host)
-		dialer := &net.Dialer{
-			Timeout: c.config.Timeout,
+		conn, err = c.dialControl(pconn, host)
+		if err == nil {
+			// like tls.DialWithDialer, default ServerName to the host
+			tlsConfig := pconn.config.TLSConfig
+			if tlsConfig.ServerName == "" {
+				tlsConfig = tlsConfig.Clone()
+				tlsConfig.ServerName, _, _ = net.SplitHostPort(host)
+			}
+
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err = tlsHandshake(tlsConn, c.config.Timeout); err != nil {
+				conn.Close()
+			} else {
+				conn = tlsConn
+			}
 		}
-		conn, err = tls.DialWithDialer(dialer, "tcp", host, pconn.config.TLSConfig)
 	} else {
 		pconn.debug("opening control connection to %s", host)
-		conn, err = net.DialTimeout("tcp", host, c.config.Timeout)
+		conn, err = c.dialControl(pconn, host)
 	}
 
 	var (
@@ -409,6 +1377,12 @@ func (c *Client) openConn(idx int, host string) (pconn *persistentConn, err erro
 		goto Error
 	}
 
+	if c.config.Host != "" {
+		if err = pconn.sendHost(); err != nil {
+			goto Error
+		}
+	}
+
 	if c.config.TLSConfig != nil && c.config.TLSMode == TLSExplicit {
 		err = pconn.logInTLS()
 	} else {
@@ -423,20 +1397,99 @@ func (c *Client) openConn(idx int, host string) (pconn *persistentConn, err erro
 		goto Error
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if c.closed {
-		err = ftpError{err: errors.New("client closed")}
+	if err = c.sendOptions(pconn); err != nil {
 		goto Error
 	}
 
-	if idx >= 0 {
-		c.allCons[idx] = pconn
+	// start out in the directory set via ChangeDir, if any
+	if err = c.syncCwd(pconn); err != nil {
+		goto Error
 	}
-	return pconn, nil
+
+	return nil
 
 Error:
 	pconn.close()
-	return nil, err
+	return err
+}
+
+// Replace pooled connection pconn's broken control connection with a new
+// one to the same host, so sendCommand can replay an idempotent command.
+func (c *Client) reconnect(pconn *persistentConn) error {
+	pconn.close()
+
+	c.mu.Lock()
+	config, credGen, closed := c.config, c.credGen, c.closed
+	c.mu.Unlock()
+
+	if closed {
+		return ftpError{err: errors.New("client closed")}
+	}
+
+	pconn.debug("reconnecting to %s", pconn.host)
+
+	pconn.config = config
+	pconn.credGen = credGen
+	pconn.features = make(map[string]string)
+	pconn.currentType = "A"
+	pconn.cwd = ""
+	pconn.setDataConn(nil)
+	pconn.epsvNotSupported = config.DisableEPSV
+	pconn.pasvAddressUnusable = false
+	pconn.dataModeFallback = false
+	pconn.broken = false
+
+	if err := c.connect(pconn); err != nil {
+		pconn.broken = true
+		return err
+	}
+
+	return nil
+}
+
+// Dial a control connection for pconn, or use the connection passed to
+// DialWithConn.
+func (c *Client) dialControl(pconn *persistentConn, host string) (net.Conn, error) {
+	if !c.singleConn {
+		return pconn.dialControl(host)
+	}
+
+	c.mu.Lock()
+	conn := c.givenConn
+	c.givenConn = nil
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil, ftpError{err: errors.New("can't reconnect: connection passed to DialWithConn is gone")}
+	}
+
+	if err := runConnCallback(pconn.config.ControlConnCallback, conn); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Send optional settings (UTF8, CLNT) after logging in. Failures are only
+// fatal if they break the connection.
+func (c *Client) sendOptions(pconn *persistentConn) error {
+	if pconn.hasFeature("UTF8") && !c.config.DisableUTF8 && c.config.PathEncoding == nil {
+		if err := pconn.sendCommandExpected(replyGroupPositiveCompletion, "OPTS UTF8 ON"); err != nil {
+			pconn.debug("error enabling UTF8: %s", err)
+			if pconn.broken {
+				return err
+			}
+		}
+	}
+
+	if c.config.ClientName != "" && pconn.hasFeature("CLNT") {
+		if err := pconn.sendCommandExpected(replyGroupPositiveCompletion, "CLNT %s", c.config.ClientName); err != nil {
+			pconn.debug("error sending CLNT: %s", err)
+			if pconn.broken {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
@@ -5,8 +5,19 @@
 package goftp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -38,6 +49,18 @@ func TestTimeoutConnect(t *testing.T) {
 	}
 }
 
+func TestDataTimeoutDefault(t *testing.T) {
+	c := newClient(Config{Timeout: time.Second}, []string{"127.0.0.1:21"})
+	if c.config.DataTimeout != time.Second {
+		t.Errorf("DataTimeout should default to Timeout, got %s", c.config.DataTimeout)
+	}
+
+	c = newClient(Config{Timeout: time.Second, DataTimeout: time.Minute}, []string{"127.0.0.1:21"})
+	if c.config.DataTimeout != time.Minute {
+		t.Errorf("Got %s", c.config.DataTimeout)
+	}
+}
+
 func TestExplicitTLS(t *testing.T) {
 	for _, addr := range ftpdAddrs {
 		config := Config{
@@ -70,6 +93,122 @@ func TestExplicitTLS(t *testing.T) {
 	}
 }
 
+func TestDataTLSConfig(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		var dataHandshakes int
+
+		config := Config{
+			User:     "goftp",
+			Password: "rocks",
+			TLSConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			DataTLSConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+					dataHandshakes++
+					return nil
+				},
+			},
+			TLSMode: TLSExplicit,
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		err = c.Retrieve("subdir/1234.bin", buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if dataHandshakes != 1 {
+			t.Errorf("Expected DataTLSConfig to be used once, got %d", dataHandshakes)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestTLSSessionReuse(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := Config{
+			User:     "goftp",
+			Password: "rocks",
+			TLSConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			TLSMode:         TLSExplicit,
+			TLSSessionReuse: true,
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		err = c.Retrieve("subdir/1234.bin", buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		// user's config shouldn't be modified
+		if config.TLSConfig.ClientSessionCache != nil || config.TLSConfig.ServerName != "" {
+			t.Error("TLSConfig was modified")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestClearDataChannel(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := Config{
+			User:     "goftp",
+			Password: "rocks",
+			TLSConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			TLSMode:          TLSExplicit,
+			ClearDataChannel: true,
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		err = c.Retrieve("subdir/1234.bin", buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
 func TestImplicitTLS(t *testing.T) {
 	closer, err := startPureFTPD(implicitTLSAddrs, "ftpd/pure-ftpd-implicittls")
 	if err != nil {
@@ -148,3 +287,1483 @@ func TestPooling(t *testing.T) {
 		t.Error("Leaked a connection")
 	}
 }
+
+func TestConnectionsPerHost(t *testing.T) {
+	config := goftpConfig
+	config.ConnectionsPerHost = 1
+
+	c, err := DialConfig(config, ftpdAddrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []*persistentConn
+	for range ftpdAddrs {
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, pconn)
+	}
+
+	// one connection to each host
+	for _, host := range c.hosts {
+		if c.numConnsPerHost[host] != 1 {
+			t.Errorf("Got %v", c.numConnsPerHost)
+		}
+	}
+
+	// all hosts are at their limit, so we have to wait
+	got := make(chan *persistentConn)
+	go func() {
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			t.Error(err)
+		}
+		got <- pconn
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("Exceeded ConnectionsPerHost")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.returnConn(conns[0])
+
+	if pconn := <-got; pconn != conns[0] {
+		t.Error("Expected to get returned connection")
+	}
+
+	for _, pconn := range conns {
+		c.returnConn(pconn)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.IdleTimeout = 50 * time.Millisecond
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Getwd(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Getwd(); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.connIdx != 1 {
+			t.Errorf("connection should have been reused, opened %d", c.connIdx)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		if _, err := c.Getwd(); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.connIdx != 2 {
+			t.Errorf("idle connection should have been replaced, opened %d", c.connIdx)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestTestOnBorrow(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.TestOnBorrow = true
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Getwd(); err != nil {
+			t.Fatal(err)
+		}
+
+		// kill the pooled connection's socket out from under it
+		for _, pconn := range c.allCons {
+			pconn.controlConn.Close()
+		}
+
+		if _, err := c.Getwd(); err != nil {
+			t.Fatalf("stale connection should have been replaced: %s", err)
+		}
+
+		if c.connIdx != 2 {
+			t.Errorf("expected a new connection, opened %d", c.connIdx)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestNoop(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+
+		// bad credentials should surface as an error
+		config := goftpConfig
+		config.Password = "wrong"
+
+		c, err = DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Noop(); err == nil {
+			t.Error("expected login error")
+		}
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		features, err := c.Features()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := features["SIZE"]; !ok {
+			t.Errorf("Expected SIZE feature, got %v", features)
+		}
+
+		// returned map is a copy
+		delete(features, "SIZE")
+
+		features, err = c.Features()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := features["SIZE"]; !ok {
+			t.Error("Features didn't return a copy")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestSite(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove("testroot/git-ignored/site")
+		if err := ioutil.WriteFile("testroot/git-ignored/site", []byte{1}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		code, msg, err := c.Site("CHMOD 600 git-ignored/site")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != 200 {
+			t.Errorf("Got %d %s", code, msg)
+		}
+
+		info, err := os.Stat("testroot/git-ignored/site")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("Got %s", info.Mode())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ResponseOverrides = map[string]StubResponse{
+			"ALLO 9999999999": {552, "Exceeded storage allocation"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Allocate(1024); err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Allocate(9999999999)
+		if fe, ok := err.(Error); !ok || fe.Code() != 552 {
+			t.Errorf("Got %v", err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestReinitialize(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ConnectionsPerHost = 2
+		config.ResponseOverrides = map[string]StubResponse{
+			"REIN": {502, "Command not implemented"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Getwd(); err != nil {
+			t.Fatal(err)
+		}
+
+		// test servers don't support REIN, so the idle connection is closed
+		if err := c.Reinitialize("goftp", "wrong"); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.numOpenConns() != 0 {
+			t.Errorf("Expected connections to be closed, got %d", c.numOpenConns())
+		}
+
+		_, err = c.Getwd()
+		if fe, ok := err.(Error); !ok || fe.Code() != replyNotLoggedIn {
+			t.Errorf("Expected login failure, got %v", err)
+		}
+
+		if err := c.Reinitialize("goftp", "rocks"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Getwd(); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestConnCallbacks(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		var numControl, numData int
+
+		config := goftpConfig
+		config.ControlConnCallback = func(conn net.Conn) error {
+			numControl++
+			tcpConn, ok := conn.(*net.TCPConn)
+			if !ok {
+				return fmt.Errorf("got %T", conn)
+			}
+			return tcpConn.SetNoDelay(true)
+		}
+		config.DataConnCallback = func(conn net.Conn) error {
+			numData++
+			tcpConn, ok := conn.(*net.TCPConn)
+			if !ok {
+				return fmt.Errorf("got %T", conn)
+			}
+			return tcpConn.SetReadBuffer(1 << 20)
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Retrieve("subdir/1234.bin", ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+
+		if numControl != 1 || numData != 1 {
+			t.Errorf("Got %d control and %d data callbacks", numControl, numData)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+
+		config.ControlConnCallback = func(net.Conn) error {
+			return errors.New("nope")
+		}
+
+		c, err = DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Getwd(); err == nil || !strings.Contains(err.Error(), "nope") {
+			t.Errorf("Got %v", err)
+		}
+
+		if c.numOpenConns() != 0 {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestDialWithConn(t *testing.T) {
+	client, server := net.Pipe()
+
+	go func() {
+		defer server.Close()
+
+		reader := textproto.NewReader(bufio.NewReader(server))
+		server.Write([]byte("220 Welcome\r\n"))
+
+		for {
+			line, err := reader.ReadLine()
+			if err != nil {
+				return
+			}
+
+			var reply string
+			switch strings.Fields(line)[0] {
+			case "USER":
+				reply = "331 Need password"
+			case "PASS":
+				reply = "230 Logged in"
+			case "PWD":
+				reply = `257 "/home/goftp" is the current directory`
+			case "QUIT":
+				reply = "221 Goodbye"
+			default:
+				reply = "502 Command not implemented"
+			}
+
+			server.Write([]byte(reply + "\r\n"))
+		}
+	}()
+
+	c, err := DialWithConn(goftpConfig, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := c.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dir != "/home/goftp" {
+		t.Errorf("Got %s", dir)
+	}
+
+	// server goes away, and the connection can't be reopened
+	server.Close()
+
+	if _, err := c.Getwd(); err == nil {
+		t.Error("Expected error")
+	}
+
+	if _, err := c.Getwd(); err == nil || !strings.Contains(err.Error(), "can't reconnect") {
+		t.Errorf("Got %v", err)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				reader := textproto.NewReader(bufio.NewReader(conn))
+				conn.Write([]byte("220 Welcome\r\n"))
+
+				typ := "A"
+
+				for {
+					line, err := reader.ReadLine()
+					if err != nil {
+						return
+					}
+
+					var reply string
+					switch strings.Fields(line)[0] {
+					case "USER":
+						reply = "331 Need password"
+					case "PASS":
+						reply = "230 Logged in"
+					case "PWD":
+						reply = `257 "/home/goftp" is the current directory`
+					case "FEAT":
+						reply = "211-Features:\r\n SIZE\r\n211 End"
+					case "TYPE":
+						typ = strings.Fields(line)[1]
+						reply = "200 Type set"
+					case "SIZE":
+						// like ProFTPD
+						if typ == "I" {
+							reply = "213 4"
+						} else {
+							reply = "550 SIZE not allowed in ASCII mode"
+						}
+					case "DELE":
+						reply = "250 Deleted"
+					case "QUIT":
+						reply = "221 Goodbye"
+					default:
+						reply = "502 Command not implemented"
+					}
+
+					conn.Write([]byte(reply + "\r\n"))
+				}
+			}()
+		}
+	}()
+
+	config := goftpConfig
+	config.ConnectionsPerHost = 1
+
+	c, err := DialConfig(config, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	// control connection drops while the connection is idle
+	dropControlConn := func() {
+		pconn := <-c.freeConnCh
+		pconn.controlConn.Close()
+		c.freeConnCh <- pconn
+	}
+
+	dropControlConn()
+
+	dir, err := c.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dir != "/home/goftp" {
+		t.Errorf("Got %s", dir)
+	}
+
+	if stats := c.Stats(); stats.Reconnects != 1 || stats.ConnsOpened != 1 || stats.OpenConns != 1 {
+		t.Errorf("Got %+v", stats)
+	}
+
+	// SIZE is replayed in binary mode
+	if _, err := c.Size("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	dropControlConn()
+
+	size, err := c.Size("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != 4 {
+		t.Errorf("Got %d", size)
+	}
+
+	// "STAT path" isn't replayed
+	dropControlConn()
+
+	if _, err := c.StatList("foo"); err == nil {
+		t.Error("Expected error")
+	}
+
+	// DELE isn't replayed
+	if _, err := c.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+
+	dropControlConn()
+
+	if err := c.Delete("foo"); err == nil {
+		t.Error("Expected error")
+	}
+
+	if stats := c.Stats(); stats.Reconnects != 2 {
+		t.Errorf("Got %+v", stats)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestReconnectCancelled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	gotMLST := make(chan struct{}, 1)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				reader := textproto.NewReader(bufio.NewReader(conn))
+				conn.Write([]byte("220 Welcome\r\n"))
+
+				for {
+					line, err := reader.ReadLine()
+					if err != nil {
+						return
+					}
+
+					var reply string
+					switch strings.Fields(line)[0] {
+					case "USER":
+						reply = "331 Need password"
+					case "PASS":
+						reply = "230 Logged in"
+					case "FEAT":
+						reply = "211-Features:\r\n MLST type*;size*;\r\n211 End"
+					case "MLST":
+						// only answer once the first attempt has been cancelled
+						select {
+						case gotMLST <- struct{}{}:
+							continue
+						default:
+						}
+						reply = "250-Listing foo\r\n type=file;size=4; foo\r\n250 End"
+					case "QUIT":
+						reply = "221 Goodbye"
+					default:
+						reply = "502 Command not implemented"
+					}
+
+					conn.Write([]byte(reply + "\r\n"))
+				}
+			}()
+		}
+	}()
+
+	c, err := DialConfig(goftpConfig, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-gotMLST
+		cancel()
+	}()
+
+	if _, err := c.StatContext(ctx, "foo"); err == nil {
+		t.Error("Expected error")
+	}
+
+	if stats := c.Stats(); stats.Reconnects != 0 {
+		t.Errorf("Got %+v", stats)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestAvailable(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ConnectionsPerHost = 1
+		config.ResponseOverrides = map[string]StubResponse{
+			"AVBL git-ignored": {213, "1048576"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// test servers don't support AVBL
+		if _, err := c.Available("git-ignored"); err == nil {
+			t.Error("Expected unsupported error")
+		}
+
+		pconn := <-c.freeConnCh
+		pconn.features["AVBL"] = ""
+		c.freeConnCh <- pconn
+
+		avail, err := c.Available("git-ignored")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if avail != 1048576 {
+			t.Errorf("Got %d", avail)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestEagerConnect(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.EagerConnect = true
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.numOpenConns() != 1 || len(c.freeConnCh) != 1 {
+			t.Errorf("Expected one idle connection, got %d open, %d idle", c.numOpenConns(), len(c.freeConnCh))
+		}
+
+		c.Close()
+
+		config.Password = "wrong"
+
+		_, err = DialConfig(config, addr)
+		if err == nil {
+			t.Error("Expected login error")
+		}
+	}
+}
+
+func TestLookupHosts(t *testing.T) {
+	hosts, err := lookupHosts([]string{"doesnt-exist.invalid", "127.0.0.1:2121"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hosts) != 1 || hosts[0] != "127.0.0.1:2121" {
+		t.Errorf("Got %v", hosts)
+	}
+
+	_, err = lookupHosts([]string{"doesnt-exist.invalid", "also-doesnt-exist.invalid"}, false)
+
+	lookupErr, ok := err.(LookupError)
+	if !ok {
+		t.Fatalf("Expected LookupError, got %v", err)
+	}
+
+	if len(lookupErr.Errors) != 2 {
+		t.Errorf("Got %v", lookupErr.Errors)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		log := new(bytes.Buffer)
+
+		config := goftpConfig
+		config.MaxRetries = 2
+		config.RetryBackoff = time.Millisecond
+		config.Logger = log
+		config.ResponseOverrides = map[string]StubResponse{
+			"DELE busy":     StubResponse{450, "busy"},
+			"DELE notfound": StubResponse{550, "not found"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// temporary errors are retried
+		if err := c.Delete("busy"); err == nil || err.(Error).Code() != 450 {
+			t.Errorf("Got %v", err)
+		}
+
+		if n := strings.Count(log.String(), "retrying"); n != 2 {
+			t.Errorf("Expected 2 retries, got %d", n)
+		}
+
+		// permanent errors are not
+		log.Reset()
+
+		if err := c.Delete("notfound"); err == nil || err.(Error).Code() != 550 {
+			t.Errorf("Got %v", err)
+		}
+
+		if n := strings.Count(log.String(), "retrying"); n != 0 {
+			t.Errorf("Expected no retries, got %d", n)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestClientName(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		log := new(bytes.Buffer)
+
+		config := goftpConfig
+		config.ClientName = "goftp-test"
+		config.Logger = log
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sent := strings.Contains(log.String(), "sending command CLNT goftp-test")
+		if sent != pconn.hasFeature("CLNT") {
+			t.Errorf("CLNT sent: %v, CLNT supported: %v", sent, pconn.hasFeature("CLNT"))
+		}
+
+		c.returnConn(pconn)
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		type command struct {
+			sent string
+			code int
+		}
+
+		var (
+			mu  sync.Mutex
+			got []command
+		)
+
+		config := goftpConfig
+		config.CommandHook = func(sent string, code int, msg string) {
+			mu.Lock()
+			got = append(got, command{sent, code})
+			mu.Unlock()
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Delete("doesnt-exist")
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var sawPass, sawNoop, sawDele bool
+		for _, cmd := range got {
+			switch cmd.sent {
+			case "PASS ******":
+				sawPass = true
+			case "NOOP":
+				sawNoop = cmd.code == 200
+			case "DELE doesnt-exist":
+				sawDele = cmd.code == 550
+			}
+
+			if strings.Contains(cmd.sent, goftpConfig.Password) {
+				t.Errorf("Password not redacted: %s", cmd.sent)
+			}
+		}
+
+		if !sawPass || !sawNoop || !sawDele {
+			t.Errorf("Got %v", got)
+		}
+	}
+}
+
+// StructuredLogger that records each message's attributes
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []map[string]interface{}
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) {
+	record := map[string]interface{}{"msg": msg}
+	for i := 0; i+1 < len(args); i += 2 {
+		record[args[i].(string)] = args[i+1]
+	}
+
+	l.mu.Lock()
+	l.records = append(l.records, record)
+	l.mu.Unlock()
+}
+
+func TestSlog(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		logger := &recordingLogger{}
+
+		config := goftpConfig
+		config.Slog = logger
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		logger.mu.Lock()
+
+		var sawNoop bool
+		for _, record := range logger.records {
+			if record["msg"] != "command" {
+				continue
+			}
+
+			if record["command"] == "NOOP" {
+				_, hasDuration := record["duration"].(time.Duration)
+				sawNoop = record["code"] == 200 && hasDuration
+			}
+
+			if strings.Contains(record["command"].(string), goftpConfig.Password) {
+				t.Errorf("Password not redacted: %s", record["command"])
+			}
+		}
+
+		if !sawNoop {
+			t.Errorf("Got %v", logger.records)
+		}
+
+		logger.mu.Unlock()
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("subdir/1234.bin", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		stats := c.Stats()
+
+		if stats.OpenConns != 1 || stats.IdleConns != 1 || stats.ConnsOpened != 1 {
+			t.Errorf("Got %+v", stats)
+		}
+
+		if stats.BytesTransferred != 4 {
+			t.Errorf("Got %+v", stats)
+		}
+
+		if stats.CommandsSent == 0 || stats.Retries != 0 {
+			t.Errorf("Got %+v", stats)
+		}
+	}
+}
+
+func TestNumConns(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.NumOpenConns() != 0 || c.NumIdleConns() != 0 {
+			t.Errorf("Got %d open, %d idle", c.NumOpenConns(), c.NumIdleConns())
+		}
+
+		// holds a connection until closed
+		r, err := c.Open("subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.NumOpenConns() != 1 || c.NumIdleConns() != 0 {
+			t.Errorf("Got %d open, %d idle", c.NumOpenConns(), c.NumIdleConns())
+		}
+
+		ioutil.ReadAll(r)
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.NumOpenConns() != 1 || c.NumIdleConns() != 1 {
+			t.Errorf("Got %d open, %d idle", c.NumOpenConns(), c.NumIdleConns())
+		}
+	}
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ConnectionsPerHost = 1
+		config.PoolWaitTimeout = 50 * time.Millisecond
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// holds the only connection until closed
+		r, err := c.Open("subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Noop()
+		if fe, ok := err.(Error); !ok || !fe.Temporary() {
+			t.Errorf("Expected temporary error, got %v", err)
+		}
+
+		ioutil.ReadAll(r)
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		var (
+			mu    sync.Mutex
+			dials []string
+		)
+
+		config := goftpConfig
+		config.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dials = append(dials, addr)
+			mu.Unlock()
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("subdir/1234.bin", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		mu.Lock()
+		// control connection plus data connection
+		if len(dials) != 2 || dials[0] != addr {
+			t.Errorf("Got %v", dials)
+		}
+		mu.Unlock()
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestDialCancelledContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	pconn := &persistentConn{config: goftpConfig, ctx: ctx}
+
+	conn, err := pconn.dial(ln.Addr().String(), time.Second)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected error")
+	}
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Got %v", err)
+	}
+}
+func TestLocalAddr(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := goftpConfig
+		config.LocalAddr = &net.TCPAddr{IP: net.ParseIP(host)}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("subdir/1234.bin", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		pconn := <-c.freeConnCh
+		localHost, _, _ := net.SplitHostPort(pconn.controlConn.LocalAddr().String())
+		if localHost != host {
+			t.Errorf("Expected control connection from %s, got %s", host, localHost)
+		}
+		c.freeConnCh <- pconn
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		var (
+			mu    sync.Mutex
+			dials int
+		)
+
+		config := goftpConfig
+		config.IgnorePASVAddress = true
+		config.Proxy = func(network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dials++
+			mu.Unlock()
+
+			return net.Dial(network, addr)
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("subdir/1234.bin", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		mu.Lock()
+		// control connection plus data connection
+		if dials != 2 {
+			t.Errorf("Got %d dials", dials)
+		}
+		mu.Unlock()
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestCloseQuit(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		var (
+			mu    sync.Mutex
+			quits []int
+		)
+
+		config := goftpConfig
+		config.CommandHook = func(sent string, code int, msg string) {
+			if sent == "QUIT" {
+				mu.Lock()
+				quits = append(quits, code)
+				mu.Unlock()
+			}
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		if len(quits) != 1 || quits[0] != 221 {
+			t.Errorf("Got %v", quits)
+		}
+		mu.Unlock()
+
+		if len(c.allCons) != 0 {
+			t.Error("Connections left open")
+		}
+	}
+}
+
+func TestSendCommand(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		code, msg, err := c.SendCommand("MDTM %s", "subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != 213 || len(msg) < 14 {
+			t.Errorf("Got %d %s", code, msg)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestSystem(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		var systs int
+
+		config := goftpConfig
+		config.CommandHook = func(sent string, code int, msg string) {
+			if sent == "SYST" {
+				systs++
+			}
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			system, err := c.System()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasPrefix(system, "UNIX") {
+				t.Errorf("Got %s", system)
+			}
+		}
+
+		if systs != 1 {
+			t.Errorf("Expected SYST to be cached, sent %d times", systs)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestParseFeatures(t *testing.T) {
+	cases := []struct {
+		msg      string
+		expected map[string]string
+	}{
+		{"Extensions supported:\n EPRT\n EPSV\n\nEND", map[string]string{"EPRT": "", "EPSV": ""}},
+		{"Features:\r\n MDTM\r\n REST STREAM\r\n size\r\nEnd", map[string]string{"MDTM": "", "REST": "STREAM", "SIZE": ""}},
+		{"Features:\n MLST type*;size*;  \n  \n UTF8\t\nEnd", map[string]string{"MLST": "type*;size*;", "UTF8": ""}},
+		{"No features", map[string]string{}},
+	}
+
+	for _, c := range cases {
+		got := parseFeatures(c.msg)
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%q: got %v", c.msg, got)
+		}
+	}
+}
+
+func TestHost(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.Host = "ftp.example.com"
+
+		// unsupported HOST is tolerated
+		config.ResponseOverrides = map[string]StubResponse{
+			"HOST ftp.example.com": StubResponse{500, "HOST not understood"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		// unknown host is an error
+		config.ResponseOverrides = map[string]StubResponse{
+			"HOST ftp.example.com": StubResponse{504, "Unknown host"},
+		}
+
+		c, err = DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Noop(); err == nil {
+			t.Error("Expected HOST error")
+		}
+	}
+}
+
+func TestPickHost(t *testing.T) {
+	c := newClient(Config{ConnectionsPerHost: 2}, []string{"a", "b", "c"})
+
+	// ties are broken round-robin
+	if host := c.pickHost(1); host != "b" {
+		t.Errorf("Got %s", host)
+	}
+
+	// least loaded host wins
+	c.numConnsPerHost["a"] = 1
+	c.numConnsPerHost["b"] = 1
+	if host := c.pickHost(0); host != "c" {
+		t.Errorf("Got %s", host)
+	}
+
+	// hosts at their limit are skipped
+	c.numConnsPerHost["c"] = 2
+	if host := c.pickHost(2); host != "a" {
+		t.Errorf("Got %s", host)
+	}
+
+	c.numConnsPerHost["a"] = 2
+	c.numConnsPerHost["b"] = 2
+	if host := c.pickHost(0); host != "" {
+		t.Errorf("Got %s", host)
+	}
+
+	// opening connections balances them across hosts
+	c = newClient(Config{ConnectionsPerHost: 3}, []string{"a", "b", "c"})
+	for i := 0; i < 6; i++ {
+		c.numConnsPerHost[c.pickHost(i*7)]++
+	}
+
+	for _, host := range c.hosts {
+		if c.numConnsPerHost[host] != 2 {
+			t.Errorf("Got %v", c.numConnsPerHost)
+		}
+	}
+}
+
+func TestCaptureResponses(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.CaptureResponses = true
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		recent := c.RecentResponses()
+		if len(recent) == 0 {
+			t.Fatal("Expected some responses")
+		}
+
+		last := recent[len(recent)-1]
+		if last.Command != "NOOP" || last.Code != 200 || last.Message == "" {
+			t.Errorf("Got %+v", last)
+		}
+
+		for _, r := range recent {
+			if strings.Contains(r.Command, goftpConfig.Password) {
+				t.Errorf("Password not redacted: %s", r.Command)
+			}
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+
+	c, err := DialConfig(goftpConfig, "127.0.0.1:21")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.RecentResponses() != nil {
+		t.Error("Expected nil without CaptureResponses")
+	}
+}
+
+func TestResponseLog(t *testing.T) {
+	var l responseLog
+
+	for i := 0; i < maxRecentResponses+10; i++ {
+		l.add(CommandResponse{Code: i})
+	}
+
+	recent := l.recent()
+	if len(recent) != maxRecentResponses {
+		t.Fatalf("Got %d responses", len(recent))
+	}
+
+	for i, r := range recent {
+		if r.Code != i+10 {
+			t.Errorf("Expected %d, got %d", i+10, r.Code)
+		}
+	}
+}
+
+func TestTLSVerificationError(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := Config{
+			User:     "goftp",
+			Password: "rocks",
+			TLSConfig: &tls.Config{
+				ServerName: "localhost",
+			},
+			TLSMode: TLSExplicit,
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Noop()
+		if err == nil {
+			t.Fatal("Expected error verifying self-signed certificate")
+		}
+
+		fe, ok := err.(Error)
+		if !ok {
+			t.Fatalf("Expected Error, got %T", err)
+		}
+
+		if !strings.Contains(err.Error(), "TLS certificate verification failed") {
+			t.Errorf("Got %s", err)
+		}
+
+		if fe.Message() != "" {
+			t.Errorf("Got message %q", fe.Message())
+		}
+
+		var uae x509.UnknownAuthorityError
+		if !errors.As(err, &uae) {
+			t.Errorf("Expected x509.UnknownAuthorityError, got %v", err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestTLSHandshakeErrorUnwrap(t *testing.T) {
+	cert := &x509.Certificate{DNSNames: []string{"example.com"}}
+
+	err := tlsHandshakeError(x509.UnknownAuthorityError{Cert: cert})
+
+	var uae x509.UnknownAuthorityError
+	if !errors.As(err, &uae) || uae.Cert != cert {
+		t.Errorf("Got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "TLS certificate verification failed") || !strings.Contains(err.Error(), "example.com") {
+		t.Errorf("Got %v", err)
+	}
+
+	if fe, ok := err.(Error); !ok || fe.Message() != "" {
+		t.Errorf("Got %v", err)
+	}
+}
@@ -6,8 +6,11 @@ package goftp
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"os"
+	pathpkg "path"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -20,36 +23,52 @@ const timeFormat = "20060102150405"
 
 // Delete deletes the file "path".
 func (c *Client) Delete(path string) error {
-	pconn, err := c.getIdleConn()
-	if err != nil {
-		return err
-	}
+	return c.retry(func() error {
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			return err
+		}
 
-	defer c.returnConn(pconn)
+		defer c.returnConn(pconn)
 
-	return pconn.sendCommandExpected(replyFileActionOkay, "DELE %s", path)
+		return pconn.sendCommandExpected(replyFileActionOkay, "DELE %s", path)
+	})
 }
 
-// Rename renames file "from" to "to".
+// Rename renames file "from" to "to". "RNFR" and "RNTO" are sent on the same
+// connection. "to" may be in a different directory than "from", in which
+// case the file is moved (if the server allows it).
 func (c *Client) Rename(from, to string) error {
-	pconn, err := c.getIdleConn()
-	if err != nil {
-		return err
-	}
+	return c.retry(func() error {
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			return err
+		}
 
-	defer c.returnConn(pconn)
+		defer c.returnConn(pconn)
 
-	err = pconn.sendCommandExpected(replyFileActionPending, "RNFR %s", from)
-	if err != nil {
-		return err
-	}
+		err = pconn.sendCommandExpected(replyFileActionPending, "RNFR %s", from)
+		if err != nil {
+			return err
+		}
 
-	return pconn.sendCommandExpected(replyFileActionOkay, "RNTO %s", to)
+		return pconn.sendCommandExpected(replyFileActionOkay, "RNTO %s", to)
+	})
 }
 
 // Mkdir creates directory "path". The returned string is how the client
 // should refer to the created directory.
 func (c *Client) Mkdir(path string) (string, error) {
+	var dir string
+	err := c.retry(func() error {
+		var err error
+		dir, err = c.mkdir(path)
+		return err
+	})
+	return dir, err
+}
+
+func (c *Client) mkdir(path string) (string, error) {
 	pconn, err := c.getIdleConn()
 	if err != nil {
 		return "", err
@@ -57,6 +76,10 @@ func (c *Client) Mkdir(path string) (string, error) {
 
 	defer c.returnConn(pconn)
 
+	return pconn.mkdir(path)
+}
+
+func (pconn *persistentConn) mkdir(path string) (string, error) {
 	code, msg, err := pconn.sendCommand("MKD %s", path)
 	if err != nil {
 		return "", err
@@ -74,16 +97,159 @@ func (c *Client) Mkdir(path string) (string, error) {
 	return dir, nil
 }
 
+// MkdirAll creates directory "path" along with any missing parents. "path"
+// may be absolute or relative to the current working directory. MkdirAll
+// returns nil if "path" already exists as a directory.
+func (c *Client) MkdirAll(path string) error {
+	var dir string
+	if strings.HasPrefix(path, "/") {
+		dir = "/"
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		dir = pathpkg.Join(dir, part)
+
+		_, err := c.Mkdir(dir)
+		if err == nil {
+			continue
+		}
+
+		if !dirExistsError(err) {
+			return err
+		}
+
+		// servers use the same codes for "already exists" as for other
+		// failures, so make sure the final directory really exists
+		if i == len(parts)-1 {
+			info, statErr := c.Stat(dir)
+			if statErr != nil || !info.IsDir() {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // Rmdir removes directory "path".
 func (c *Client) Rmdir(path string) error {
-	pconn, err := c.getIdleConn()
+	return c.retry(func() error {
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			return err
+		}
+
+		defer c.returnConn(pconn)
+
+		return pconn.sendCommandExpected(replyFileActionOkay, "RMD %s", path)
+	})
+}
+
+// RemoveAll removes "path" and, if it is a directory, everything it contains
+// (deleting depth-first). Directories are listed with ReadDir, or with
+// "NLST" if ReadDir can't list them. Symlinks are deleted, not followed.
+// RemoveAll returns nil if "path" doesn't exist, otherwise it returns the
+// first error encountered.
+func (c *Client) RemoveAll(path string) error {
+	// files and symlinks can be deleted directly
+	deleteErr := c.Delete(path)
+	if deleteErr == nil {
+		return nil
+	}
+
+	if fe, ok := deleteErr.(Error); !ok || fe.Code()/100 != 5 {
+		return deleteErr
+	}
+
+	// otherwise, hopefully it is a directory (550 doesn't necessarily mean
+	// it's missing)
+	exists, err := c.Exists(path)
 	if err != nil {
 		return err
 	}
 
-	defer c.returnConn(pconn)
+	if !exists {
+		return nil
+	}
+
+	entries, names, err := c.listForRemove(path)
+	if err != nil {
+		if fe, ok := err.(Error); ok && fe.Code()/100 == 5 {
+			// not a directory either, so report why it couldn't be deleted
+			return deleteErr
+		}
+		return err
+	}
+
+	return c.removeDir(path, entries, names)
+}
+
+// List dir for RemoveAll. If ReadDir can't list dir, the names from "NLST"
+// are returned instead, since their types aren't known.
+func (c *Client) listForRemove(dir string) ([]os.FileInfo, []string, error) {
+	entries, err := c.ReadDir(dir)
+	if err == nil || !listingUnusable(err) {
+		return entries, nil, err
+	}
+
+	c.debug("falling back to NLST to list %s: %s", dir, err)
+
+	lines, err := c.dataStringList(context.Background(), "NLST %s", dir)
+	if err != nil {
+		if emptyDirError(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	var names []string
+	for _, line := range lines {
+		// some servers include the directory in each name
+		name := pathpkg.Base(line)
+		if name != "." && name != ".." && name != "/" {
+			names = append(names, name)
+		}
+	}
 
-	return pconn.sendCommandExpected(replyFileActionOkay, "RMD %s", path)
+	return nil, names, nil
+}
+
+// Remove dir's contents, as listed by listForRemove, and then dir.
+func (c *Client) removeDir(dir string, entries []os.FileInfo, names []string) error {
+	for _, entry := range entries {
+		entryPath := pathpkg.Join(dir, entry.Name())
+
+		var err error
+		if entry.IsDir() && entry.Mode()&os.ModeSymlink == 0 {
+			var (
+				subEntries []os.FileInfo
+				subNames   []string
+			)
+			subEntries, subNames, err = c.listForRemove(entryPath)
+			if err == nil {
+				err = c.removeDir(entryPath, subEntries, subNames)
+			}
+		} else {
+			err = c.Delete(entryPath)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if err := c.RemoveAll(pathpkg.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return c.Rmdir(dir)
 }
 
 // Getwd returns the current working directory.
@@ -95,6 +261,44 @@ func (c *Client) Getwd() (string, error) {
 
 	defer c.returnConn(pconn)
 
+	return pconn.getwd()
+}
+
+// ChangeDir changes the working directory using the "CWD" command. Relative
+// paths passed to other Client methods are resolved against the new
+// directory. Since the Client uses a pool of connections, the new directory
+// is remembered (as an absolute path, via "PWD") and "CWD" is re-issued on
+// each newly opened connection, and on each pooled connection before it is
+// next used.
+func (c *Client) ChangeDir(path string) error {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return err
+	}
+
+	defer c.returnConn(pconn)
+
+	if err := pconn.sendCommandExpected(replyFileActionOkay, "CWD %s", path); err != nil {
+		return err
+	}
+
+	dir, err := pconn.getwd()
+	if err != nil {
+		// we don't know where this connection is anymore
+		pconn.broken = true
+		return err
+	}
+
+	pconn.cwd = dir
+
+	c.mu.Lock()
+	c.cwd = dir
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (pconn *persistentConn) getwd() (string, error) {
 	code, msg, err := pconn.sendCommand("PWD")
 	if err != nil {
 		return "", err
@@ -104,17 +308,156 @@ func (c *Client) Getwd() (string, error) {
 		return "", ftpError{code: code, msg: msg}
 	}
 
-	dir, err := extractDirName(msg)
+	return extractDirName(msg)
+}
+
+// ModTime fetches the modification time of file "path" using the "MDTM"
+// command. This is cheaper than Stat, but requires the server to support
+// "MDTM", and typically only works for files (not directories).
+func (c *Client) ModTime(path string) (time.Time, error) {
+	pconn, err := c.getIdleConn()
 	if err != nil {
-		return "", err
+		return time.Time{}, err
 	}
 
-	return dir, nil
+	defer c.returnConn(pconn)
+
+	if !pconn.hasFeature("MDTM") {
+		return time.Time{}, unsupportedError("MDTM")
+	}
+
+	code, msg, err := pconn.sendCommand("MDTM %s", path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if code != replyFileStatus {
+		return time.Time{}, ftpError{code: code, msg: msg}
+	}
+
+	// some servers include fractional seconds (e.g. "20150216084148.123")
+	timeVal := msg
+	if dot := strings.Index(timeVal, "."); dot != -1 {
+		timeVal = timeVal[:dot]
+	}
+
+	mtime, err := time.ParseInLocation(timeFormat, timeVal, time.UTC)
+	if err != nil {
+		return time.Time{}, ftpError{err: fmt.Errorf("failed parsing MDTM response: %s", msg)}
+	}
+
+	return mtime, nil
+}
+
+// SetModTime sets the modification time of file "path" to "t" using the
+// "MFMT" command. The server must support "MFMT".
+func (c *Client) SetModTime(path string, t time.Time) error {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return err
+	}
+
+	defer c.returnConn(pconn)
+
+	if !pconn.hasFeature("MFMT") {
+		return unsupportedError("MFMT")
+	}
+
+	return pconn.sendCommandExpected(replyFileStatus, "MFMT %s %s", t.UTC().Format(timeFormat), path)
+}
+
+// Touch creates "path" as an empty file if it doesn't exist, otherwise it
+// updates the file's modification time using "MFMT". Existing files are
+// never truncated, so Touch is suitable for creating lock files and
+// completion markers. If the server doesn't support "MFMT", Touch appends
+// nothing to the file instead, which may not change an existing file's
+// modification time.
+func (c *Client) Touch(path string) error {
+	err := c.SetModTime(path, time.Now())
+	if err == nil {
+		return nil
+	}
+
+	// Appending nothing creates the file if necessary without truncating
+	// it. Other errors (e.g. a dropped connection) are returned as is.
+	if mfmtUnsupportedError(err) {
+		return c.Append(path, bytes.NewReader(nil))
+	}
+
+	if !fileNotFoundError(err) {
+		return err
+	}
+
+	// 550 may also mean e.g. permission denied, so only create the file if
+	// it really doesn't exist
+	if exists, existsErr := c.Exists(path); existsErr != nil || exists {
+		return err
+	}
+
+	return c.Append(path, bytes.NewReader(nil))
+}
+
+// Whether SetModTime failed because the server doesn't support "MFMT".
+func mfmtUnsupportedError(err error) bool {
+	if fe, ok := err.(ftpError); ok && fe.unsupported {
+		return true
+	}
+	return commandNotSupporterdError(err)
+}
+
+func fileNotFoundError(err error) bool {
+	fe, ok := err.(Error)
+	return ok && fe.Code() == replyFileError
+}
+
+// Whether err indicates a file doesn't exist. Besides 550, some servers reply
+// 450 (e.g. "450 No such file or directory") to "LIST" of a missing path.
+func missingFileError(err error) bool {
+	fe, ok := err.(Error)
+	return ok && (fe.Code() == replyFileError || fe.Code() == replyTransientFileError)
+}
+
+// Whether err may indicate a directory already exists (servers aren't
+// consistent about this).
+func dirExistsError(err error) bool {
+	fe, ok := err.(Error)
+	return ok && (fe.Code() == replyFileError || fe.Code() == replyDirAlreadyExists)
+}
+
+// Some servers reply with an error (e.g. "550 No files found") rather than an
+// empty listing when a directory is empty. Errors for directories that don't
+// exist (e.g. "550 No such file or directory") don't match.
+func emptyDirError(err error) bool {
+	fe, ok := err.(Error)
+	if !ok || (fe.Code() != replyTransientFileError && fe.Code() != replyFileError) {
+		return false
+	}
+
+	msg := strings.ToLower(fe.Message())
+	for _, empty := range []string{"no files", "directory is empty", "empty directory", "no entries"} {
+		if strings.Contains(msg, empty) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func commandNotSupporterdError(err error) bool {
-	respCode := err.(ftpError).Code()
-	return respCode == replyCommandSyntaxError || respCode == replyCommandNotImplemented
+	fe, ok := err.(Error)
+	return ok && (fe.Code() == replyCommandSyntaxError || fe.Code() == replyCommandNotImplemented)
+}
+
+// Whether ReadDir failed because the server can't list directories in a
+// form it understands (neither "MLSD" nor "LIST" is supported, or the
+// "LIST" output couldn't be parsed).
+func listingUnusable(err error) bool {
+	if commandNotSupporterdError(err) {
+		return true
+	}
+
+	fe, ok := err.(ftpError)
+	return ok && fe.err != nil && fe.Code() == 0 && !fe.Temporary()
 }
 
 // ReadDir fetches the contents of a directory, returning a list of
@@ -123,19 +466,45 @@ func commandNotSupporterdError(err error) bool {
 // directories. The os.FileInfo's fields may be incomplete depending on what
 // the server supports. If the server does not support "MLSD", "LIST" will
 // be used. You may have to set ServerLocation in your config to get (more)
-// accurate ModTimes in this case.
+// accurate ModTimes in this case. Servers that reply "550 No files found"
+// (or similar) for an empty directory result in an empty list, not an error.
 func (c *Client) ReadDir(path string) ([]os.FileInfo, error) {
-	entries, err := c.dataStringList("MLSD %s", path)
+	return c.ReadDirContext(context.Background(), path)
+}
+
+// ReadDirContext is like ReadDir, but gives up if ctx is done before the
+// listing completes, including while reading the listing from the data
+// connection. Control connection deadlines are also capped at ctx's deadline,
+// if it has one. A connection interrupted this way is discarded rather than
+// returned to the pool.
+func (c *Client) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	return c.readDir(path, func(f string, args ...interface{}) ([]string, error) {
+		return c.dataStringList(ctx, f, args...)
+	})
+}
 
-	parser := parseMLST
+// Fetch and parse the listing of path, using list to run "MLSD" or "LIST".
+func (c *Client) readDir(path string, list func(f string, args ...interface{}) ([]string, error)) ([]os.FileInfo, error) {
+	entries, err := list("MLSD %s", path)
+
+	parser := func(entry string, skipSelfParent bool) (os.FileInfo, error) {
+		return parseMLST(entry, c.config.StrictMLST, skipSelfParent)
+	}
 
 	if err != nil {
+		if emptyDirError(err) {
+			return []os.FileInfo{}, nil
+		}
+
 		if !commandNotSupporterdError(err) {
 			return nil, err
 		}
 
-		entries, err = c.dataStringList("LIST %s", path)
+		entries, err = list("LIST %s", path)
 		if err != nil {
+			if emptyDirError(err) {
+				return []os.FileInfo{}, nil
+			}
 			return nil, err
 		}
 		parser = func(entry string, skipSelfParent bool) (os.FileInfo, error) {
@@ -161,16 +530,136 @@ func (c *Client) ReadDir(path string) ([]os.FileInfo, error) {
 	return ret, nil
 }
 
+// ReadDirStream is like ReadDir, but calls fn with each entry as it is read
+// from the server rather than collecting them all first, which saves memory
+// for huge directories. If fn returns an error, the listing is abandoned and
+// that error is returned. Unlike ReadDir, failures aren't retried (see
+// Config.MaxRetries), since fn may already have seen some entries.
+func (c *Client) ReadDirStream(path string, fn func(os.FileInfo) error) error {
+	var started bool
+
+	parser := func(entry string, skipSelfParent bool) (os.FileInfo, error) {
+		return parseMLST(entry, c.config.StrictMLST, skipSelfParent)
+	}
+
+	handle := func(entry string) error {
+		started = true
+
+		info, err := parser(entry, true)
+		if err != nil {
+			c.debug("error in ReadDirStream: %s", err)
+			return err
+		}
+
+		if info == nil {
+			return nil
+		}
+
+		return fn(info)
+	}
+
+	err := c.dataLines(context.Background(), handle, "MLSD %s", path)
+	if err != nil && !started && commandNotSupporterdError(err) {
+		parser = func(entry string, skipSelfParent bool) (os.FileInfo, error) {
+			return parseLIST(entry, c.config.ServerLocation, skipSelfParent)
+		}
+		err = c.dataLines(context.Background(), handle, "LIST %s", path)
+	}
+
+	if err != nil && !started && emptyDirError(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Glob returns the entries of a directory whose names match the final
+// element of "pattern", using the syntax of path.Match (e.g. "logs/*.txt").
+// The directory portion of "pattern" may not contain wildcards. Matching is
+// done client-side on the results of ReadDir.
+func (c *Client) Glob(pattern string) ([]os.FileInfo, error) {
+	// check the pattern is well formed
+	if _, err := pathpkg.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	dir, file := pathpkg.Split(pattern)
+	if strings.ContainsAny(dir, `*?[\`) {
+		return nil, ftpError{err: fmt.Errorf("wildcards are only supported in the last element of %s", pattern)}
+	}
+
+	entries, err := c.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []os.FileInfo
+	for _, entry := range entries {
+		if matched, _ := pathpkg.Match(file, entry.Name()); matched {
+			matches = append(matches, entry)
+		}
+	}
+
+	return matches, nil
+}
+
+// List returns the raw lines of a "LIST" of "path", without any parsing.
+// This is useful for displaying listings verbatim or for parsing unusual
+// listing formats.
+func (c *Client) List(path string) ([]string, error) {
+	return c.dataStringList(context.Background(), "LIST %s", path)
+}
+
+// StatList is like ReadDir, but fetches the listing with the "STAT" command,
+// which returns it over the control connection instead of a data
+// connection. This works even when data connections are blocked by a
+// firewall. The listing is in "LIST" format, so you may have to set
+// ServerLocation in your config to get (more) accurate ModTimes.
+func (c *Client) StatList(path string) ([]os.FileInfo, error) {
+	lines, err := c.controlStringList(context.Background(), "STAT %s", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// first and last lines are status text ("Status of foo:", "End of status")
+	if len(lines) < 2 {
+		return nil, ftpError{err: fmt.Errorf("unexpected STAT response: %v", lines)}
+	}
+
+	var ret []os.FileInfo
+	for _, line := range lines[1 : len(lines)-1] {
+		info, err := parseLIST(strings.TrimLeft(line, " "), c.config.ServerLocation, true)
+		if err != nil {
+			c.debug("error in StatList: %s", err)
+			return nil, err
+		}
+
+		if info == nil {
+			continue
+		}
+
+		ret = append(ret, info)
+	}
+
+	return ret, nil
+}
+
 // Stat fetches details for a particular file. The os.FileInfo's fields may
 // be incomplete depending on what the server supports. If the server doesn't
 // support "MLST", "LIST" will be attempted, but "LIST" will not work if path
 // is a directory. You may have to set ServerLocation in your config to get
 // (more) accurate ModTimes when using "LIST".
 func (c *Client) Stat(path string) (os.FileInfo, error) {
-	lines, err := c.controlStringList("MLST %s", path)
+	return c.StatContext(context.Background(), path)
+}
+
+// StatContext is like Stat, but gives up if ctx is done before the server
+// responds (see ReadDirContext).
+func (c *Client) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	lines, err := c.controlStringList(ctx, "MLST %s", path)
 	if err != nil {
 		if commandNotSupporterdError(err) {
-			lines, err = c.dataStringList("LIST %s", path)
+			lines, err = c.dataStringList(ctx, "LIST %s", path)
 			if err != nil {
 				return nil, err
 			}
@@ -188,21 +677,146 @@ func (c *Client) Stat(path string) (os.FileInfo, error) {
 		return nil, ftpError{err: fmt.Errorf("unexpected MLST response: %v", lines)}
 	}
 
-	return parseMLST(strings.TrimLeft(lines[1], " "), false)
+	return parseMLST(strings.TrimLeft(lines[1], " "), c.config.StrictMLST, false)
 }
 
+// Exists reports whether "path" exists. A 550 ("file not found") reply
+// results in false and no error, as does a 450, which some servers send for
+// "LIST" of a missing path; other errors (e.g. connection failures) are
+// returned. Servers that don't support "MLST" are handled by looking for
+// "path" in a listing of its parent directory if necessary.
+func (c *Client) Exists(path string) (bool, error) {
+	_, err := c.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+
+	if missingFileError(err) {
+		return false, nil
+	}
+
+	if fe, ok := err.(Error); !ok || fe.Code() != 0 || fe.Temporary() {
+		return false, err
+	}
+
+	// Stat couldn't make sense of the "LIST" fallback (e.g. because path is
+	// a directory), so look for path in its parent instead
+	entries, err := c.ReadDir(pathpkg.Dir(path))
+	if err != nil {
+		if missingFileError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	name := pathpkg.Base(path)
+	for _, entry := range entries {
+		if entry.Name() == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Symlink creates "newname" as a symbolic link to "oldname" using the
+// non-standard "SITE SYMLINK" command (supported by e.g. ProFTPD's
+// mod_site_misc). Like os.Symlink, "oldname" is stored as is, so relative
+// targets are resolved relative to the link's directory.
+func (c *Client) Symlink(oldname, newname string) error {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return err
+	}
+
+	defer c.returnConn(pconn)
+
+	return pconn.sendCommandExpected(replyCommandOkay, "SITE SYMLINK %s %s", oldname, newname)
+}
+
+// Readlink returns the target of symlink "path". The target is taken from
+// the "MLST" type fact if the server includes it there, otherwise "LIST"
+// output is parsed.
+func (c *Client) Readlink(path string) (string, error) {
+	info, err := c.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if target := SymlinkTarget(info); target != "" {
+		return target, nil
+	}
+
+	lines, err := c.dataStringList(context.Background(), "LIST %s", path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range lines {
+		entry, err := parseLIST(line, c.config.ServerLocation, true)
+		if err != nil || entry == nil {
+			continue
+		}
+
+		if target := SymlinkTarget(entry); target != "" && entry.Name() == filepath.Base(path) {
+			return target, nil
+		}
+	}
+
+	return "", ftpError{err: fmt.Errorf("%s is not a symlink", path)}
+}
+
+// extractDirName parses the quoted path out of a 257 reply. Per RFC 959
+// Appendix II, quotes inside the path are doubled, and the path ends at the
+// first undoubled quote (anything after it is commentary).
 func extractDirName(msg string) (string, error) {
 	openQuote := strings.Index(msg, "\"")
-	closeQuote := strings.LastIndex(msg, "\"")
-	if openQuote == -1 || len(msg) == openQuote+1 || closeQuote <= openQuote {
+	if openQuote == -1 {
 		return "", ftpError{
 			err: fmt.Errorf("failed parsing directory name: %s", msg),
 		}
 	}
-	return strings.Replace(msg[openQuote+1:closeQuote], `""`, `"`, -1), nil
+
+	var dir []byte
+	for i := openQuote + 1; i < len(msg); i++ {
+		if msg[i] != '"' {
+			dir = append(dir, msg[i])
+			continue
+		}
+
+		if i+1 < len(msg) && msg[i+1] == '"' {
+			dir = append(dir, '"')
+			i++
+			continue
+		}
+
+		if len(dir) == 0 {
+			break
+		}
+
+		return string(dir), nil
+	}
+
+	return "", ftpError{
+		err: fmt.Errorf("failed parsing directory name: %s", msg),
+	}
 }
 
-func (c *Client) controlStringList(f string, args ...interface{}) ([]string, error) {
+func (c *Client) controlStringList(ctx context.Context, f string, args ...interface{}) ([]string, error) {
+	var lines []string
+	err := c.retry(func() error {
+		var err error
+		lines, err = c.controlStringListOnce(ctx, f, args...)
+		return err
+	})
+	return lines, err
+}
+
+func (c *Client) controlStringListOnce(ctx context.Context, f string, args ...interface{}) (lines []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+
 	pconn, err := c.getIdleConn()
 	if err != nil {
 		return nil, err
@@ -210,9 +824,21 @@ func (c *Client) controlStringList(f string, args ...interface{}) ([]string, err
 
 	defer c.returnConn(pconn)
 
+	defer pconn.setContext(ctx)()
+
+	// errors caused by interrupting the connection should report why
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = contextError(ctx.Err())
+		}
+	}()
+
 	cmd := fmt.Sprintf(f, args...)
 
-	code, msg, err := pconn.sendCommand(cmd)
+	code, msg, err := pconn.sendCommand("%s", cmd)
+	if err != nil {
+		return nil, err
+	}
 
 	if !positiveCompletionReply(code) {
 		pconn.debug("unexpected response to %s: %d-%s", cmd, code, msg)
@@ -222,48 +848,123 @@ func (c *Client) controlStringList(f string, args ...interface{}) ([]string, err
 	return strings.Split(msg, "\n"), nil
 }
 
-func (c *Client) dataStringList(f string, args ...interface{}) ([]string, error) {
+func (c *Client) dataStringList(ctx context.Context, f string, args ...interface{}) ([]string, error) {
+	var lines []string
+
+	appendLine := func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}
+
+	for attempt, restarts := 0, 0; ; {
+		lines = nil
+
+		err := c.dataLines(ctx, appendLine, f, args...)
+		if err == nil {
+			return lines, nil
+		}
+
+		if listingInterrupted(err) && restarts < c.config.ListingRetries && ctx.Err() == nil {
+			restarts++
+			c.debug("restarting listing (attempt %d of %d): %s", restarts, c.config.ListingRetries, err)
+			continue
+		}
+
+		if !c.shouldRetry(attempt, err) {
+			return nil, err
+		}
+
+		attempt++
+	}
+}
+
+// Report whether err means a listing's data connection failed partway
+// through (see Config.ListingRetries).
+func listingInterrupted(err error) bool {
+	fe, ok := err.(ftpError)
+	return ok && fe.interrupted
+}
+
+// Send a command whose output arrives over a data connection (e.g. "LIST"),
+// passing each line to fn as it is read. If fn returns an error, the output
+// is abandoned (and the connection discarded) and that error is returned.
+func (c *Client) dataLines(ctx context.Context, fn func(line string) error, f string, args ...interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return contextError(err)
+	}
+
 	pconn, err := c.getIdleConn()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	defer c.returnConn(pconn)
 
+	return c.dataLinesOnConn(ctx, pconn, fn, f, args...)
+}
+
+// Like dataLines, but using pconn rather than a connection from the pool.
+func (c *Client) dataLinesOnConn(ctx context.Context, pconn *persistentConn, fn func(line string) error, f string, args ...interface{}) (err error) {
+	defer pconn.setContext(ctx)()
+
+	// errors caused by interrupting the connection should report why
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = contextError(ctx.Err())
+		}
+	}()
+
 	dcGetter, err := pconn.prepareDataConn()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	cmd := fmt.Sprintf(f, args...)
 
-	err = pconn.sendCommandExpected(replyGroupPreliminaryReply, cmd)
+	err = pconn.sendCommandExpected(replyGroupPreliminaryReply, "%s", cmd)
 	if err != nil {
-		return nil, err
+		pconn.closeActiveListener()
+		return err
 	}
 
 	dc, err := dcGetter()
 	if err != nil {
-		return nil, err
+		// the server is still expecting (or has given up on) the data
+		// connection, so we don't know what it will send next
+		pconn.broken = true
+		return err
 	}
 
 	// to catch early returns
 	defer dc.Close()
 
 	scanner := bufio.NewScanner(dc)
-	scanner.Split(bufio.ScanLines)
+	scanner.Split(scanAnyLines)
 
-	var res []string
 	for scanner.Scan() {
-		res = append(res, scanner.Text())
+		if scanner.Text() == "" {
+			continue
+		}
+
+		if err = fn(pconn.decode(scanner.Text())); err != nil {
+			// the rest of the output and the final reply are still on
+			// their way, so don't reuse the connection
+			pconn.broken = true
+			return err
+		}
 	}
 
-	var dataError error
 	if err = scanner.Err(); err != nil {
 		pconn.debug("error reading %s data: %s", cmd, err)
-		dataError = ftpError{
-			err:       fmt.Errorf("error reading %s data: %s", cmd, err),
-			temporary: true,
+
+		// the rest of the listing and the final reply may still be on
+		// their way, so don't reuse the connection
+		pconn.broken = true
+
+		return ftpError{
+			err:         fmt.Errorf("error reading %s data: %s", cmd, err),
+			temporary:   true,
+			interrupted: true,
 		}
 	}
 
@@ -274,27 +975,89 @@ func (c *Client) dataStringList(f string, args ...interface{}) ([]string, error)
 
 	code, msg, err := pconn.readResponse()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if !positiveCompletionReply(code) {
 		pconn.debug("unexpected result: %d-%s", code, msg)
-		return nil, ftpError{code: code, msg: msg}
+		// 426 means the data connection closed early
+		return ftpError{code: code, msg: msg, interrupted: code == replyConnectionClosed}
+	}
+
+	return nil
+}
+
+// bufio.SplitFunc like bufio.ScanLines, but lines may end with "\r\n", "\n"
+// or a lone "\r" (some Windows servers mix them in listings).
+func scanAnyLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
 	}
 
-	if dataError != nil {
-		return nil, dataError
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+
+		// "\r", which may be the first half of "\r\n"
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+
+		// need more data to tell
+		return 0, nil, nil
 	}
 
-	return res, nil
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
 }
 
 type ftpFile struct {
-	name  string
-	size  int64
-	mode  os.FileMode
-	mtime time.Time
-	raw   string
+	name   string
+	size   int64
+	mode   os.FileMode
+	mtime  time.Time
+	facts  FileFacts
+	target string // symlink target, if known
+}
+
+// FileFacts holds details about a file beyond what os.FileInfo provides. It
+// is returned (as a *FileFacts) by the Sys method of the os.FileInfo's
+// returned by ReadDir and Stat. Only "MLST"/"MLSD" entries include the
+// ownership and Unique facts; they are empty (or -1 for UID and GID) if the
+// server didn't report them. The raw listing entry is available as Raw (or
+// String()).
+type FileFacts struct {
+	// Owner and group names ("UNIX.ownername"/"UNIX.groupname", or
+	// "UNIX.owner"/"UNIX.group", which some servers report as IDs).
+	Owner string
+	Group string
+
+	// Numeric owner and group IDs ("UNIX.uid"/"UNIX.gid", or numeric
+	// "UNIX.owner"/"UNIX.group").
+	UID int
+	GID int
+
+	// Identifier that is the same for all names of the same file ("unique").
+	Unique string
+
+	// The entry as received from the server.
+	Raw string
+}
+
+// String returns the raw entry.
+func (f *FileFacts) String() string {
+	return f.Raw
 }
 
 func (f *ftpFile) Name() string {
@@ -318,7 +1081,25 @@ func (f *ftpFile) IsDir() bool {
 }
 
 func (f *ftpFile) Sys() interface{} {
-	return f.raw
+	return &f.facts
+}
+
+// Target returns the symlink target, or empty string if the file isn't a
+// symlink or the server didn't report the target.
+func (f *ftpFile) Target() string {
+	return f.target
+}
+
+// SymlinkTarget returns the symlink target of a file returned by ReadDir or
+// Stat, or empty string if unknown. Servers only sometimes report symlink
+// targets in listings; see Readlink for a more thorough approach.
+func SymlinkTarget(info os.FileInfo) string {
+	if t, ok := info.(interface {
+		Target() string
+	}); ok {
+		return t.Target()
+	}
+	return ""
 }
 
 var lsRegex = regexp.MustCompile(`^\s*(\S)(\S{3})(\S{3})(\S{3})(?:\s+\S+){3}\s+(\d+)\s+(\w+\s+\d+)\s+([\d:]+)\s+(.+)$`)
@@ -332,6 +1113,9 @@ func parseLIST(entry string, loc *time.Location, skipSelfParent bool) (os.FileIn
 
 	matches := lsRegex.FindStringSubmatch(entry)
 	if len(matches) == 0 {
+		if dosMatches := dosRegex.FindStringSubmatch(entry); len(dosMatches) > 0 {
+			return parseDOSLIST(entry, dosMatches, loc, skipSelfParent)
+		}
 		return nil, ftpError{err: fmt.Errorf(`failed parsing LIST entry: %s`, entry)}
 	}
 
@@ -364,39 +1148,179 @@ func parseLIST(entry string, loc *time.Location, skipSelfParent bool) (os.FileIn
 		return nil, ftpError{err: fmt.Errorf(`failed parsing LIST entry's size: %s (%s)`, err, entry)}
 	}
 
-	var mtime time.Time
-	if strings.Contains(matches[7], ":") {
-		mtime, err = time.ParseInLocation("Jan _2 15:04", matches[6]+" "+matches[7], loc)
-		if err == nil {
-			now := time.Now()
-			year := now.Year()
-			if mtime.Month() > now.Month() {
-				year--
-			}
-			mtime, err = time.ParseInLocation("Jan _2 15:04 2006", matches[6]+" "+matches[7]+" "+strconv.Itoa(year), loc)
+	mtime, err := parseLISTTime(matches[6]+" "+matches[7], loc, time.Now())
+	if err != nil {
+		return nil, ftpError{err: fmt.Errorf(`failed parsing LIST entry's mtime: %s (%s)`, err, entry)}
+	}
+
+	name := matches[8]
+
+	// symlinks look like "name -> target"
+	var target string
+	if mode&os.ModeSymlink != 0 {
+		if arrow := strings.Index(name, " -> "); arrow != -1 {
+			name, target = name[:arrow], name[arrow+4:]
 		}
-	} else {
-		mtime, err = time.ParseInLocation("Jan _2 2006", matches[6]+" "+matches[7], loc)
 	}
 
+	info := &ftpFile{
+		name:   filepath.Base(name),
+		mode:   mode,
+		mtime:  mtime,
+		facts:  FileFacts{Raw: entry, UID: -1, GID: -1},
+		size:   int64(size),
+		target: target,
+	}
+
+	return info, nil
+}
+
+var dosRegex = regexp.MustCompile(`^\s*(\d{2}-\d{2}-(?:\d{2}|\d{4})\s+\d{1,2}:\d{2}\s*(?:[AaPp][Mm])?)\s+(<DIR>|\d+)\s+(.+)$`)
+
+// DOS/Windows style LIST output (e.g. from IIS):
+// 04-22-09  11:55PM       <DIR>          some dir
+// 04-26-09  02:12PM           1089207168 some file.avi
+func parseDOSLIST(entry string, matches []string, loc *time.Location, skipSelfParent bool) (os.FileInfo, error) {
+	name := matches[3]
+	if skipSelfParent && (name == "." || name == "..") {
+		return nil, nil
+	}
+
+	mtime, err := parseLISTTime(matches[1], loc, time.Now())
 	if err != nil {
 		return nil, ftpError{err: fmt.Errorf(`failed parsing LIST entry's mtime: %s (%s)`, err, entry)}
 	}
 
 	info := &ftpFile{
-		name:  filepath.Base(matches[8]),
-		mode:  mode,
+		name:  name,
 		mtime: mtime,
-		raw:   entry,
-		size:  int64(size),
+		facts: FileFacts{Raw: entry, UID: -1, GID: -1},
+	}
+
+	// no permission info, just say it's readable to us
+	if matches[2] == "<DIR>" {
+		info.mode = os.ModeDir | 0500
+	} else {
+		size, err := strconv.ParseInt(matches[2], 10, 64)
+		if err != nil {
+			return nil, ftpError{err: fmt.Errorf(`failed parsing LIST entry's size: %s (%s)`, err, entry)}
+		}
+		info.size = size
+		info.mode = 0400
 	}
 
 	return info, nil
 }
 
+var dosTimeRegex = regexp.MustCompile(`^(\d{2})-(\d{2})-(\d{2}|\d{4})\s+(\d{1,2}):(\d{2})\s*([AaPp][Mm])?$`)
+
+// Parse the human readable timestamps found in "LIST" output, in loc. These
+// look like "Apr 22 23:55" (ls, within the last year), "Apr 22  2009" (ls,
+// older) or "04-22-09  11:55PM" (DOS/Windows). The ls style without a year
+// refers to the most recent such time that isn't in the future relative to
+// now (allowing a day of clock skew).
+func parseLISTTime(s string, loc *time.Location, now time.Time) (time.Time, error) {
+	if matches := dosTimeRegex.FindStringSubmatch(s); len(matches) > 0 {
+		return parseDOSTime(matches, loc)
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return time.Time{}, fmt.Errorf("unknown time format: %s", s)
+	}
+	s = strings.Join(fields, " ")
+
+	if !strings.Contains(fields[2], ":") {
+		return time.ParseInLocation("Jan 2 2006", s, loc)
+	}
+
+	year := now.In(loc).Year()
+	t, err := time.ParseInLocation("Jan 2 15:04 2006", s+" "+strconv.Itoa(year), loc)
+	if err != nil {
+		return t, err
+	}
+
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+
+	return t, nil
+}
+
+func parseDOSTime(matches []string, loc *time.Location) (time.Time, error) {
+	var fields [5]int
+	for i := range fields {
+		n, err := strconv.Atoi(matches[i+1])
+		if err != nil {
+			return time.Time{}, err
+		}
+		fields[i] = n
+	}
+
+	month, day, year, hour, min := fields[0], fields[1], fields[2], fields[3], fields[4]
+
+	if len(matches[3]) == 2 {
+		// same pivot as time.Parse's "06"
+		if year >= 69 {
+			year += 1900
+		} else {
+			year += 2000
+		}
+	}
+
+	switch strings.ToUpper(matches[6]) {
+	case "AM":
+		if hour == 12 {
+			hour = 0
+		}
+	case "PM":
+		if hour != 12 {
+			hour += 12
+		}
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || min > 59 {
+		return time.Time{}, fmt.Errorf("invalid date: %02d-%02d-%d %02d:%02d", month, day, year, hour, min)
+	}
+
+	return time.Date(year, time.Month(month), day, hour, min, 0, 0, loc), nil
+}
+
+// Approximate Unix permission bits from an MLST "perm" fact (see
+// http://tools.ietf.org/html/rfc3659#section-7.5.5). The fact only describes
+// our own access, so read and execute access is reported for everyone and
+// write access for the owner, giving e.g. 0755 for a directory we can list
+// and create files in, or 0644 for a file we can read and write.
+func permMode(perm string, isDir bool) os.FileMode {
+	var mode os.FileMode
+	for _, c := range strings.ToLower(perm) {
+		// 'd' (delete) and 'f' (rename) depend on the parent directory's
+		// permissions, not this entry's, so they're ignored
+		switch {
+		case isDir && c == 'l':
+			// can list entries means readable and searchable
+			mode |= 0555
+		case isDir && c == 'e':
+			// can enter (CWD) means searchable
+			mode |= 0111
+		case isDir && (c == 'c' || c == 'm' || c == 'p'):
+			// can create files, make subdirectories or purge entries
+			mode |= 0200
+		case !isDir && c == 'r':
+			mode |= 0444
+		case !isDir && (c == 'a' || c == 'w'):
+			// can append or write
+			mode |= 0200
+		}
+	}
+
+	return mode
+}
+
 // an entry looks something like this:
 // type=file;size=12;modify=20150216084148;UNIX.mode=0644;unique=1000004g1187ec7; lorem.txt
-func parseMLST(entry string, skipSelfParent bool) (os.FileInfo, error) {
+// If strict, a missing "modify" fact is an error rather than a zero mtime.
+func parseMLST(entry string, strict, skipSelfParent bool) (os.FileInfo, error) {
 	parseError := ftpError{err: fmt.Errorf(`failed parsing MLST entry: %s`, entry)}
 	incompleteError := ftpError{err: fmt.Errorf(`MLST entry incomplete: %s`, entry)}
 
@@ -411,10 +1335,10 @@ func parseMLST(entry string, skipSelfParent bool) (os.FileInfo, error) {
 		if len(factParts) != 2 {
 			return nil, parseError
 		}
-		facts[strings.ToLower(factParts[0])] = strings.ToLower(factParts[1])
+		facts[strings.ToLower(factParts[0])] = factParts[1]
 	}
 
-	typ := facts["type"]
+	typ := strings.ToLower(facts["type"])
 
 	if typ == "" {
 		return nil, incompleteError
@@ -432,30 +1356,23 @@ func parseMLST(entry string, skipSelfParent bool) (os.FileInfo, error) {
 		}
 		mode = os.FileMode(m)
 	} else if facts["perm"] != "" {
-		// see http://tools.ietf.org/html/rfc3659#section-7.5.5
-		for _, c := range facts["perm"] {
-			switch c {
-			case 'a', 'd', 'c', 'f', 'm', 'p', 'w':
-				// these suggest you have write permissions
-				mode |= 0200
-			case 'l':
-				// can list dir entries means readable and executable
-				mode |= 0500
-			case 'r':
-				// readable file
-				mode |= 0400
-			}
-		}
+		mode = permMode(facts["perm"], typ == "dir" || typ == "cdir" || typ == "pdir")
 	} else {
 		// no mode info, just say it's readable to us
 		mode = 0400
 	}
 
+	var target string
 	if typ == "dir" || typ == "cdir" || typ == "pdir" {
 		mode |= os.ModeDir
 	} else if strings.HasPrefix(typ, "os.unix=slink") || strings.HasPrefix(typ, "os.unix=symlink") {
 		// note: there is no general way to determine whether a symlink points to a dir or a file
 		mode |= os.ModeSymlink
+
+		// some servers include the target, e.g. "OS.unix=slink:/some/target"
+		if colon := strings.Index(facts["type"], ":"); colon != -1 {
+			target = facts["type"][colon+1:]
+		}
 	}
 
 	var (
@@ -467,7 +1384,7 @@ func parseMLST(entry string, skipSelfParent bool) (os.FileInfo, error) {
 		size, err = strconv.ParseInt(facts["size"], 10, 64)
 	} else if mode.IsDir() && facts["sizd"] != "" {
 		size, err = strconv.ParseInt(facts["sizd"], 10, 64)
-	} else if facts["type"] == "file" {
+	} else if typ == "file" {
 		return nil, incompleteError
 	}
 
@@ -475,22 +1392,59 @@ func parseMLST(entry string, skipSelfParent bool) (os.FileInfo, error) {
 		return nil, parseError
 	}
 
-	if facts["modify"] == "" {
-		return nil, incompleteError
-	}
-
-	mtime, err := time.ParseInLocation(timeFormat, facts["modify"], time.UTC)
-	if err != nil {
+	var mtime time.Time
+	if facts["modify"] != "" {
+		mtime, err = time.ParseInLocation(timeFormat, facts["modify"], time.UTC)
+		if err != nil {
+			return nil, incompleteError
+		}
+	} else if strict {
 		return nil, incompleteError
 	}
 
 	info := &ftpFile{
-		name:  filepath.Base(parts[1]),
-		size:  size,
-		mtime: mtime,
-		raw:   entry,
-		mode:  mode,
+		name:   filepath.Base(parts[1]),
+		size:   size,
+		mtime:  mtime,
+		facts:  mlstFacts(facts, entry),
+		mode:   mode,
+		target: target,
 	}
 
 	return info, nil
 }
+
+func mlstFacts(facts map[string]string, entry string) FileFacts {
+	ret := FileFacts{
+		Owner:  facts["unix.ownername"],
+		Group:  facts["unix.groupname"],
+		UID:    -1,
+		GID:    -1,
+		Unique: facts["unique"],
+		Raw:    entry,
+	}
+
+	if ret.Owner == "" {
+		ret.Owner = facts["unix.owner"]
+	}
+
+	if ret.Group == "" {
+		ret.Group = facts["unix.group"]
+	}
+
+	for _, fact := range []string{"unix.uid", "unix.owner"} {
+		if id, err := strconv.Atoi(facts[fact]); err == nil {
+			ret.UID = id
+			break
+		}
+	}
+
+	for _, fact := range []string{"unix.gid", "unix.group"} {
+		if id, err := strconv.Atoi(facts[fact]); err == nil {
+			ret.GID = id
+			break
+		}
+	}
+
+	return ret
+}
@@ -5,14 +5,22 @@
 package goftp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/textproto"
 	"os"
 	"path"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -87,6 +95,48 @@ func TestRename(t *testing.T) {
 	}
 }
 
+func TestRenameAcrossDirs(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("testroot/git-ignored/rename-dest")
+		os.Remove("testroot/git-ignored/rename-src")
+
+		if err := os.Mkdir("testroot/git-ignored/rename-dest", 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Store("git-ignored/rename-src", bytes.NewReader([]byte{1, 2, 3, 4}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Rename("git-ignored/rename-src", "git-ignored/rename-dest/moved"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat("testroot/git-ignored/rename-src"); !os.IsNotExist(err) {
+			t.Errorf("Expected source to be gone, got %v", err)
+		}
+
+		newContents, err := ioutil.ReadFile("testroot/git-ignored/rename-dest/moved")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(newContents, []byte{1, 2, 3, 4}) {
+			t.Error("file contents wrong", newContents)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
 func TestMkdirRmdir(t *testing.T) {
 	for _, addr := range ftpdAddrs {
 		c, err := DialConfig(Config{User: "goftp", Password: "rocks"}, addr)
@@ -137,6 +187,165 @@ func TestMkdirRmdir(t *testing.T) {
 	}
 }
 
+func TestRemoveAll(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("testroot/git-ignored/tree")
+
+		if err := os.MkdirAll("testroot/git-ignored/tree/a/b", 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range []string{"tree/foo", "tree/a/bar", "tree/a/b/baz"} {
+			if err := ioutil.WriteFile("testroot/git-ignored/"+f, []byte{1, 2, 3, 4}, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// symlink pointing outside the tree should be deleted, not followed
+		if err := os.Symlink("../../../subdir", "testroot/git-ignored/tree/a/link"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.RemoveAll("git-ignored/tree"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat("testroot/git-ignored/tree"); !os.IsNotExist(err) {
+			t.Error("tree should be gone")
+		}
+
+		if _, err := os.Stat("testroot/subdir/1234.bin"); err != nil {
+			t.Error("symlink target should still exist")
+		}
+
+		// missing path isn't an error
+		if err := c.RemoveAll("git-ignored/tree"); err != nil {
+			t.Error(err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRemoveAllRefused(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ResponseOverrides = map[string]StubResponse{
+			"DELE git-ignored/refused": {550, "Permission denied"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile("testroot/git-ignored/refused", []byte{1, 2, 3, 4}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.RemoveAll("git-ignored/refused")
+		if fe, ok := err.(Error); !ok || fe.Code() != 550 || fe.Message() != "Permission denied" {
+			t.Errorf("Got %v", err)
+		}
+
+		if _, err := os.Stat("testroot/git-ignored/refused"); err != nil {
+			t.Error("file shouldn't have been deleted")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRemoveAllNameList(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ResponseOverrides = map[string]StubResponse{
+			"MLSD git-ignored/nlst-tree": {502, "Command not implemented"},
+			"LIST git-ignored/nlst-tree": {502, "Command not implemented"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("testroot/git-ignored/nlst-tree")
+
+		if err := os.MkdirAll("testroot/git-ignored/nlst-tree/a", 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range []string{"nlst-tree/foo", "nlst-tree/a/bar"} {
+			if err := ioutil.WriteFile("testroot/git-ignored/"+f, []byte{1, 2, 3, 4}, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := c.RemoveAll("git-ignored/nlst-tree"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat("testroot/git-ignored/nlst-tree"); !os.IsNotExist(err) {
+			t.Error("tree should be gone")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("testroot/git-ignored/mkdirall")
+
+		if err := c.MkdirAll("git-ignored/mkdirall/a/b"); err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := os.Stat("testroot/git-ignored/mkdirall/a/b")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !stat.IsDir() {
+			t.Error("should be a dir")
+		}
+
+		// existing directories are fine
+		if err := c.MkdirAll("git-ignored/mkdirall/a/b"); err != nil {
+			t.Error(err)
+		}
+
+		// but not if the path exists as a file
+		if err := ioutil.WriteFile("testroot/git-ignored/mkdirall/file", []byte{1}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.MkdirAll("git-ignored/mkdirall/file"); err == nil {
+			t.Error("expected error")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
 func mustParseTime(f, s string) time.Time {
 	t, err := time.Parse(timeFormat, s)
 	if err != nil {
@@ -145,6 +354,28 @@ func mustParseTime(f, s string) time.Time {
 	return t
 }
 
+func TestPermMode(t *testing.T) {
+	cases := []struct {
+		perm  string
+		isDir bool
+		exp   os.FileMode
+	}{
+		{"flcdmpe", true, 0755},
+		{"fle", true, 0555},
+		{"e", true, 0111},
+		{"adfrw", false, 0644},
+		{"r", false, 0444},
+		{"dfw", false, 0200},
+		{"", false, 0},
+	}
+
+	for _, c := range cases {
+		if got := permMode(c.perm, c.isDir); got != c.exp {
+			t.Errorf("%s (dir=%v): expected %s, got %s", c.perm, c.isDir, c.exp, got)
+		}
+	}
+}
+
 func TestParseMLST(t *testing.T) {
 	cases := []struct {
 		raw string
@@ -154,6 +385,7 @@ func TestParseMLST(t *testing.T) {
 			// dirs dont necessarily have size
 			"modify=19991014192630;perm=fle;type=dir;unique=806U246E0B1;UNIX.group=1;UNIX.mode=0755;UNIX.owner=0; files",
 			&ftpFile{
+				facts: FileFacts{Owner: "0", Group: "1", UID: 0, GID: 1, Unique: "806U246E0B1"},
 				name:  "files",
 				mtime: mustParseTime(timeFormat, "19991014192630"),
 				mode:  os.FileMode(0755) | os.ModeDir,
@@ -163,6 +395,7 @@ func TestParseMLST(t *testing.T) {
 			// xlightftp (windows ftp server) mlsd output I found
 			"size=1089207168;type=file;modify=20090426141232; adsl TV 2009-04-22 23-55-05 Jazz Icons   Lionel Hampton Live in 1958 [Mezzo].avi",
 			&ftpFile{
+				facts: FileFacts{UID: -1, GID: -1},
 				name:  "adsl TV 2009-04-22 23-55-05 Jazz Icons   Lionel Hampton Live in 1958 [Mezzo].avi",
 				mtime: mustParseTime(timeFormat, "20090426141232"),
 				mode:  os.FileMode(0400),
@@ -173,6 +406,7 @@ func TestParseMLST(t *testing.T) {
 			// test "type=OS.unix=slink"
 			"type=OS.unix=slink:;size=32;modify=20140728100902;UNIX.mode=0777;UNIX.uid=647;UNIX.gid=649;unique=fd01g1220c04; access-logs",
 			&ftpFile{
+				facts: FileFacts{UID: 647, GID: 649, Unique: "fd01g1220c04"},
 				name:  "access-logs",
 				mtime: mustParseTime(timeFormat, "20140728100902"),
 				mode:  os.FileMode(0777) | os.ModeSymlink,
@@ -183,18 +417,40 @@ func TestParseMLST(t *testing.T) {
 			// test "type=OS.unix=symlink"
 			"modify=20150928140340;perm=adfrw;size=6;type=OS.unix=symlink;unique=801U5AA227;UNIX.group=1000;UNIX.mode=0777;UNIX.owner=1000; slinkdir",
 			&ftpFile{
+				facts: FileFacts{Owner: "1000", Group: "1000", UID: 1000, GID: 1000, Unique: "801U5AA227"},
 				name:  "slinkdir",
 				mtime: mustParseTime(timeFormat, "20150928140340"),
 				mode:  os.FileMode(0777) | os.ModeSymlink,
 				size:  6,
 			},
 		},
+		{
+			// symlink target included in type fact
+			"type=OS.unix=slink:/Some/Target;size=12;modify=20140728100902;UNIX.mode=0777; link",
+			&ftpFile{
+				facts:  FileFacts{UID: -1, GID: -1},
+				name:   "link",
+				mtime:  mustParseTime(timeFormat, "20140728100902"),
+				mode:   os.FileMode(0777) | os.ModeSymlink,
+				size:   12,
+				target: "/Some/Target",
+			},
+		},
+		{
+			// no modify fact
+			"type=OS.unix=socket;UNIX.mode=0755; sock",
+			&ftpFile{
+				facts: FileFacts{UID: -1, GID: -1},
+				name:  "sock",
+				mode:  os.FileMode(0755),
+			},
+		},
 	}
 
 	for _, c := range cases {
-		c.exp.raw = c.raw
+		c.exp.facts.Raw = c.raw
 
-		got, err := parseMLST(c.raw, false)
+		got, err := parseMLST(c.raw, false, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -202,73 +458,136 @@ func TestParseMLST(t *testing.T) {
 		if !reflect.DeepEqual(gotFile, c.exp) {
 			t.Errorf("exp %+v\n got %+v", c.exp, gotFile)
 		}
+
+		if SymlinkTarget(got) != c.exp.target {
+			t.Errorf("exp target %q, got %q", c.exp.target, SymlinkTarget(got))
+		}
+	}
+
+	if _, err := parseMLST("type=OS.unix=socket;UNIX.mode=0755; sock", true, false); err == nil {
+		t.Error("Expected error for missing modify fact in strict mode")
 	}
 }
 
-func compareFileInfos(a, b os.FileInfo) error {
-	if a.Name() != b.Name() {
-		return fmt.Errorf("Name(): %s != %s", a.Name(), b.Name())
+func TestParseLIST(t *testing.T) {
+	cases := []struct {
+		raw string
+		exp *ftpFile
+	}{
+		{
+			"drwxr-xr-x   8 goftp    20            272 Jul 28  2014 git-ignored",
+			&ftpFile{
+				name:  "git-ignored",
+				mtime: time.Date(2014, 7, 28, 0, 0, 0, 0, time.UTC),
+				mode:  os.FileMode(0755) | os.ModeDir,
+				size:  272,
+			},
+		},
+		{
+			"lrwxrwxrwx   1 goftp    goftp          12 Feb 16  2015 link -> ../lorem.txt",
+			&ftpFile{
+				name:   "link",
+				mtime:  time.Date(2015, 2, 16, 0, 0, 0, 0, time.UTC),
+				mode:   os.FileMode(0777) | os.ModeSymlink,
+				size:   12,
+				target: "../lorem.txt",
+			},
+		},
+		{
+			// IIS style
+			"04-22-09  11:55PM       <DIR>          some dir",
+			&ftpFile{
+				name:  "some dir",
+				mtime: time.Date(2009, 4, 22, 23, 55, 0, 0, time.UTC),
+				mode:  os.FileMode(0500) | os.ModeDir,
+			},
+		},
+		{
+			"04-26-2009  12:12AM           1089207168 Lionel Hampton Live in 1958 [Mezzo].avi",
+			&ftpFile{
+				name:  "Lionel Hampton Live in 1958 [Mezzo].avi",
+				mtime: time.Date(2009, 4, 26, 0, 12, 0, 0, time.UTC),
+				mode:  os.FileMode(0400),
+				size:  1089207168,
+			},
+		},
 	}
 
-	// reporting of size for directories is inconsistent
-	if !a.IsDir() {
-		if a.Size() != b.Size() {
-			return fmt.Errorf("Size(): %d != %d", a.Size(), b.Size())
+	for _, c := range cases {
+		c.exp.facts = FileFacts{Raw: c.raw, UID: -1, GID: -1}
+
+		got, err := parseLIST(c.raw, time.UTC, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotFile := got.(*ftpFile)
+		if !reflect.DeepEqual(gotFile, c.exp) {
+			t.Errorf("exp %+v\n got %+v", c.exp, gotFile)
 		}
 	}
+}
 
-	if a.Mode() != b.Mode() {
-		return fmt.Errorf("Mode(): %s != %s", a.Mode(), b.Mode())
-	}
+func TestParseLISTTime(t *testing.T) {
+	now := time.Date(2015, 3, 10, 12, 0, 0, 0, time.UTC)
 
-	if !a.ModTime().Truncate(time.Minute).Equal(b.ModTime().Truncate(time.Minute)) {
-		return fmt.Errorf("ModTime() %s != %s", a.ModTime(), b.ModTime())
+	cases := []struct {
+		raw string
+		exp time.Time
+	}{
+		{"Mar  9 23:55", time.Date(2015, 3, 9, 23, 55, 0, 0, time.UTC)},
+		// later in the current month means last year
+		{"Mar 20 08:00", time.Date(2014, 3, 20, 8, 0, 0, 0, time.UTC)},
+		{"Dec 31 08:00", time.Date(2014, 12, 31, 8, 0, 0, 0, time.UTC)},
+		// allow for clock skew
+		{"Mar 11 08:00", time.Date(2015, 3, 11, 8, 0, 0, 0, time.UTC)},
+		{"Jul 28  2014", time.Date(2014, 7, 28, 0, 0, 0, 0, time.UTC)},
+		{"04-22-09  11:55PM", time.Date(2009, 4, 22, 23, 55, 0, 0, time.UTC)},
+		{"04-26-2009  12:12AM", time.Date(2009, 4, 26, 0, 12, 0, 0, time.UTC)},
+		{"10-31-14  14:02", time.Date(2014, 10, 31, 14, 2, 0, 0, time.UTC)},
 	}
 
-	if a.IsDir() != b.IsDir() {
-		return fmt.Errorf("IsDir(): %v != %v", a.IsDir(), b.IsDir())
+	for _, c := range cases {
+		got, err := parseLISTTime(c.raw, time.UTC, now)
+		if err != nil {
+			t.Errorf("%s: %s", c.raw, err)
+			continue
+		}
+
+		if !got.Equal(c.exp) {
+			t.Errorf("%s: expected %s, got %s", c.raw, c.exp, got)
+		}
 	}
 
-	return nil
+	for _, raw := range []string{"yesterday", "Foo 22 23:55", "13-22-09  11:55PM"} {
+		if _, err := parseLISTTime(raw, time.UTC, now); err == nil {
+			t.Errorf("%s: expected error", raw)
+		}
+	}
 }
 
-func TestReadDir(t *testing.T) {
+func TestReadlink(t *testing.T) {
 	for _, addr := range ftpdAddrs {
 		c, err := DialConfig(goftpConfig, addr)
-
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		list, err := c.ReadDir("")
-
-		if err != nil {
+		os.Remove("testroot/git-ignored/link")
+		if err := os.Symlink("../lorem.txt", "testroot/git-ignored/link"); err != nil {
 			t.Fatal(err)
 		}
 
-		if len(list) != 4 {
-			t.Errorf("expected 3 items, got %d", len(list))
+		target, err := c.Readlink("git-ignored/link")
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		var names []string
-
-		for _, item := range list {
-			expected, err := os.Stat("testroot/" + item.Name())
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			if err := compareFileInfos(item, expected); err != nil {
-				t.Errorf("mismatch on %s: %s (%s)", item.Name(), err, item.Sys().(string))
-			}
-
-			names = append(names, item.Name())
+		if target != "../lorem.txt" {
+			t.Errorf("Got %s", target)
 		}
 
-		// sanity check names are what we expected
-		sort.Strings(names)
-		if !reflect.DeepEqual(names, []string{"email%40mail.com.txt", "git-ignored", "lorem.txt", "subdir"}) {
-			t.Errorf("got: %v", names)
+		if _, err := c.Readlink("lorem.txt"); err == nil {
+			t.Error("expected error for non-symlink")
 		}
 
 		if c.numOpenConns() != len(c.freeConnCh) {
@@ -277,12 +596,112 @@ func TestReadDir(t *testing.T) {
 	}
 }
 
-func TestReadDirNoMLSD(t *testing.T) {
-	// pureFTPD seems to have some issues with timestamps in LIST output
-	for _, addr := range proAddrs {
+func TestSymlink(t *testing.T) {
+	for _, addr := range ftpdAddrs {
 		config := goftpConfig
-		config.stubResponses = map[string]stubResponse{
-			"MLSD ": {500, "'MLSD ': command not understood."},
+		config.ResponseOverrides = map[string]StubResponse{
+			"SITE SYMLINK ../lorem.txt git-ignored/link": {200, "SITE SYMLINK command successful"},
+			"SITE SYMLINK lorem.txt git-ignored":         {550, "git-ignored: File exists"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Symlink("../lorem.txt", "git-ignored/link"); err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Symlink("lorem.txt", "git-ignored")
+		if fe, ok := err.(Error); !ok || fe.Code() != 550 {
+			t.Errorf("Got %v", err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func compareFileInfos(a, b os.FileInfo) error {
+	if a.Name() != b.Name() {
+		return fmt.Errorf("Name(): %s != %s", a.Name(), b.Name())
+	}
+
+	// reporting of size for directories is inconsistent
+	if !a.IsDir() {
+		if a.Size() != b.Size() {
+			return fmt.Errorf("Size(): %d != %d", a.Size(), b.Size())
+		}
+	}
+
+	if a.Mode() != b.Mode() {
+		return fmt.Errorf("Mode(): %s != %s", a.Mode(), b.Mode())
+	}
+
+	if !a.ModTime().Truncate(time.Minute).Equal(b.ModTime().Truncate(time.Minute)) {
+		return fmt.Errorf("ModTime() %s != %s", a.ModTime(), b.ModTime())
+	}
+
+	if a.IsDir() != b.IsDir() {
+		return fmt.Errorf("IsDir(): %v != %v", a.IsDir(), b.IsDir())
+	}
+
+	return nil
+}
+
+func TestReadDir(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := c.ReadDir("")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list) != 4 {
+			t.Errorf("expected 3 items, got %d", len(list))
+		}
+
+		var names []string
+
+		for _, item := range list {
+			expected, err := os.Stat("testroot/" + item.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := compareFileInfos(item, expected); err != nil {
+				t.Errorf("mismatch on %s: %s (%s)", item.Name(), err, item.Sys())
+			}
+
+			names = append(names, item.Name())
+		}
+
+		// sanity check names are what we expected
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, []string{"email%40mail.com.txt", "git-ignored", "lorem.txt", "subdir"}) {
+			t.Errorf("got: %v", names)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestReadDirNoMLSD(t *testing.T) {
+	// pureFTPD seems to have some issues with timestamps in LIST output
+	for _, addr := range proAddrs {
+		config := goftpConfig
+		config.ResponseOverrides = map[string]StubResponse{
+			"MLSD ": {500, "'MLSD ': command not understood."},
 		}
 
 		c, err := DialConfig(config, addr)
@@ -310,7 +729,7 @@ func TestReadDirNoMLSD(t *testing.T) {
 			}
 
 			if err := compareFileInfos(item, expected); err != nil {
-				t.Errorf("mismatch on %s: %s (%s)", item.Name(), err, item.Sys().(string))
+				t.Errorf("mismatch on %s: %s (%s)", item.Name(), err, item.Sys())
 			}
 
 			names = append(names, item.Name())
@@ -328,6 +747,136 @@ func TestReadDirNoMLSD(t *testing.T) {
 	}
 }
 
+func TestList(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines, err := c.List("subdir")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var found bool
+		for _, line := range lines {
+			if strings.HasSuffix(line, " 1234.bin") {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("Got %v", lines)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestReadDirUTF8(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("testroot/git-ignored/utf8")
+		if err := os.MkdirAll("testroot/git-ignored/utf8", 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile("testroot/git-ignored/utf8/héllo wörld.txt", []byte{1}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := c.ReadDir("git-ignored/utf8")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list) != 1 || list[0].Name() != "héllo wörld.txt" {
+			t.Errorf("Got %v", list)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("git-ignored/utf8/héllo wörld.txt", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+// Latin-1 PathEncoding for tests
+type latin1 struct{}
+
+func (latin1) Encode(s string) (string, error) {
+	var buf []byte
+	for _, r := range s {
+		if r > 0xff {
+			return "", fmt.Errorf("can't encode %q as latin-1", r)
+		}
+		buf = append(buf, byte(r))
+	}
+	return string(buf), nil
+}
+
+func (latin1) Decode(s string) (string, error) {
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes), nil
+}
+
+func TestPathEncoding(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.PathEncoding = latin1{}
+
+		c, err := DialConfig(config, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("testroot/git-ignored/latin1")
+		if err := os.MkdirAll("testroot/git-ignored/latin1", 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		// "héllo.txt" in latin-1
+		if err := ioutil.WriteFile("testroot/git-ignored/latin1/h\xe9llo.txt", []byte{1}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := c.ReadDir("git-ignored/latin1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list) != 1 || list[0].Name() != "héllo.txt" {
+			t.Errorf("Got %v", list)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("git-ignored/latin1/héllo.txt", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
 func TestStat(t *testing.T) {
 	for _, addr := range ftpdAddrs {
 		c, err := DialConfig(goftpConfig, addr)
@@ -397,7 +946,7 @@ func TestStatNoMLST(t *testing.T) {
 	// pureFTPD seems to have some issues with timestamps in LIST output
 	for _, addr := range proAddrs {
 		config := goftpConfig
-		config.stubResponses = map[string]stubResponse{
+		config.ResponseOverrides = map[string]StubResponse{
 			"MLST ":                {500, "'MLST ': command not understood."},
 			"MLST subdir/1234.bin": {500, "'MLST ': command not understood."},
 			"MLST subdir":          {500, "'MLST ': command not understood."},
@@ -429,6 +978,88 @@ func TestStatNoMLST(t *testing.T) {
 		}
 	}
 }
+func TestModTime(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mtime, err := c.ModTime("subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		realStat, err := os.Stat("testroot/subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !mtime.Equal(realStat.ModTime().Truncate(time.Second)) {
+			t.Errorf("ModTime() %s != %s", mtime, realStat.ModTime())
+		}
+
+		if _, err := c.ModTime("doesnt-exist"); err == nil {
+			t.Error("expected error for missing file")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestSetModTime(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		supported := pconn.hasFeature("MFMT")
+		c.returnConn(pconn)
+
+		if !supported {
+			if err := c.SetModTime("git-ignored/foo", time.Now()); err == nil {
+				t.Error("expected unsupported error")
+			}
+			continue
+		}
+
+		os.Remove("testroot/git-ignored/foo")
+
+		err = c.Store("git-ignored/foo", bytes.NewReader([]byte{1, 2, 3, 4}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mtime := time.Date(2009, 4, 26, 14, 12, 32, 0, time.UTC)
+		if err := c.SetModTime("git-ignored/foo", mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		realStat, err := os.Stat("testroot/git-ignored/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !realStat.ModTime().Equal(mtime) {
+			t.Errorf("ModTime() %s != %s", realStat.ModTime(), mtime)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
 func TestGetwd(t *testing.T) {
 	for _, addr := range ftpdAddrs {
 		c, err := DialConfig(goftpConfig, addr)
@@ -480,3 +1111,730 @@ func TestGetwd(t *testing.T) {
 		}
 	}
 }
+
+func TestChangeDir(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// open a second connection before changing directory
+		pconn, err := c.getIdleConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.ChangeDir("subdir"); err != nil {
+			t.Fatal(err)
+		}
+
+		c.returnConn(pconn)
+
+		if err := c.ChangeDir("doesnt-exist"); err == nil {
+			t.Error("Expected error changing to nonexistent dir")
+		}
+
+		// both connections should now be in subdir
+		var conns []*persistentConn
+		for i := 0; i < 2; i++ {
+			pconn, err := c.getIdleConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conns = append(conns, pconn)
+
+			dir, err := pconn.getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if path.Base(dir) != "subdir" {
+				t.Errorf("Got %s", dir)
+			}
+		}
+
+		for _, pconn := range conns {
+			c.returnConn(pconn)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("1234.bin", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestStatList(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := c.StatList("subdir")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list) != 1 {
+			t.Fatalf("Got %v", list)
+		}
+
+		info := list[0]
+
+		if info.Name() != "1234.bin" || info.Size() != 4 || info.IsDir() {
+			t.Errorf("Got %s %d %v", info.Name(), info.Size(), info.IsDir())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestExists(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for path, expected := range map[string]bool{
+			"subdir/1234.bin": true,
+			"subdir":          true,
+			"doesnt-exist":    false,
+			"subdir/nope.bin": false,
+		} {
+			exists, err := c.Exists(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if exists != expected {
+				t.Errorf("%s: expected %v", path, expected)
+			}
+		}
+
+		// without MLST support
+		c.config.ResponseOverrides = map[string]StubResponse{
+			"MLST subdir": {500, "'MLST subdir': command not understood."},
+		}
+
+		exists, err := c.Exists("subdir")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !exists {
+			t.Error("Expected subdir to exist")
+		}
+
+		// "LIST" of a missing path gets a 450
+		c.config.ResponseOverrides = map[string]StubResponse{
+			"MLST doesnt-exist": {500, "'MLST doesnt-exist': command not understood."},
+			"LIST doesnt-exist": {450, "No such file or directory"},
+		}
+
+		exists, err = c.Exists("doesnt-exist")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exists {
+			t.Error("Expected doesnt-exist not to exist")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestExtractDirName(t *testing.T) {
+	for msg, expected := range map[string]string{
+		`"/foo" created`:                 "/foo",
+		`"/foo""bar" created`:            `/foo"bar`,
+		`"/foo""" created`:               `/foo"`,
+		`"/foo" created, see "/foo/bar"`: "/foo",
+		`MKD command successful "/foo"`:  "/foo",
+	} {
+		dir, err := extractDirName(msg)
+		if err != nil {
+			t.Errorf("%s: %s", msg, err)
+		}
+
+		if dir != expected {
+			t.Errorf("%s: got %s", msg, dir)
+		}
+	}
+
+	for _, msg := range []string{`created`, `"" created`, `"/foo created`} {
+		if _, err := extractDirName(msg); err == nil {
+			t.Errorf("%s: expected error", msg)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for pattern, expected := range map[string][]string{
+			"*.txt":        {"email%40mail.com.txt", "lorem.txt"},
+			"subdir/*.bin": {"1234.bin"},
+			"subdir/*.txt": nil,
+		} {
+			entries, err := c.Glob(pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			sort.Strings(names)
+
+			if !reflect.DeepEqual(names, expected) {
+				t.Errorf("%s: got %v", pattern, names)
+			}
+		}
+
+		if _, err := c.Glob("sub*/*.bin"); err == nil {
+			t.Error("Expected error for wildcard in directory")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestTouch(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove("testroot/git-ignored/touch")
+
+		if err := c.Touch("git-ignored/touch"); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := os.Stat("testroot/git-ignored/touch")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Size() != 0 {
+			t.Errorf("Expected empty file, got %d bytes", info.Size())
+		}
+
+		// touching an existing file leaves its contents alone
+		if err := ioutil.WriteFile("testroot/git-ignored/touch", []byte{1, 2}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Touch("git-ignored/touch"); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadFile("testroot/git-ignored/touch")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2}, got) {
+			t.Errorf("Got %v", got)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestTouchTemporaryError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var appended int32
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := textproto.NewReader(bufio.NewReader(conn))
+		conn.Write([]byte("220 Welcome\r\n"))
+
+		for {
+			line, err := reader.ReadLine()
+			if err != nil {
+				return
+			}
+
+			var reply string
+			switch strings.Fields(line)[0] {
+			case "USER":
+				reply = "331 Need password"
+			case "PASS":
+				reply = "230 Logged in"
+			case "FEAT":
+				reply = "211-Features:\r\n MFMT\r\n211 End"
+			case "MFMT":
+				reply = "450 Try again later"
+			case "EPSV", "PASV", "APPE":
+				atomic.AddInt32(&appended, 1)
+				reply = "502 Command not implemented"
+			case "QUIT":
+				reply = "221 Goodbye"
+			default:
+				reply = "502 Command not implemented"
+			}
+
+			conn.Write([]byte(reply + "\r\n"))
+		}
+	}()
+
+	c, err := DialConfig(goftpConfig, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// a temporary MFMT failure doesn't fall back to appending
+	err = c.Touch("foo")
+	if fe, ok := err.(Error); !ok || fe.Code() != 450 {
+		t.Errorf("Got %v", err)
+	}
+
+	if n := atomic.LoadInt32(&appended); n != 0 {
+		t.Errorf("Expected no append, got %d commands", n)
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestTouchMFMTFileError(t *testing.T) {
+	for _, exists := range []bool{true, false} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var appended int32
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			reader := textproto.NewReader(bufio.NewReader(conn))
+			conn.Write([]byte("220 Welcome\r\n"))
+
+			for {
+				line, err := reader.ReadLine()
+				if err != nil {
+					return
+				}
+
+				var reply string
+				switch strings.Fields(line)[0] {
+				case "USER":
+					reply = "331 Need password"
+				case "PASS":
+					reply = "230 Logged in"
+				case "FEAT":
+					reply = "211-Features:\r\n MFMT\r\n MLST type*;size*;\r\n211 End"
+				case "MFMT":
+					reply = "550 Permission denied"
+				case "MLST":
+					if exists {
+						reply = "250-Listing foo\r\n type=file;size=4; foo\r\n250 End"
+					} else {
+						reply = "550 No such file or directory"
+					}
+				case "TYPE":
+					reply = "200 Type set"
+				case "EPSV", "PASV", "APPE":
+					atomic.AddInt32(&appended, 1)
+					reply = "502 Command not implemented"
+				case "QUIT":
+					reply = "221 Goodbye"
+				default:
+					reply = "502 Command not implemented"
+				}
+
+				conn.Write([]byte(reply + "\r\n"))
+			}
+		}()
+
+		c, err := DialConfig(goftpConfig, ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Touch("foo")
+
+		n := atomic.LoadInt32(&appended)
+		if exists {
+			// the file is there, so the MFMT error is returned as is
+			if fe, ok := err.(Error); !ok || fe.Code() != 550 || fe.Message() != "Permission denied" {
+				t.Errorf("Got %v", err)
+			}
+
+			if n != 0 {
+				t.Errorf("Expected no append, got %d commands", n)
+			}
+		} else if n == 0 {
+			t.Error("Expected append of missing file")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+
+		c.Close()
+		ln.Close()
+	}
+}
+
+func TestReadDirContext(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		entries, err := c.ReadDirContext(ctx, "subdir")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(entries) != 1 || entries[0].Name() != "1234.bin" {
+			t.Errorf("Got %v", entries)
+		}
+
+		info, err := c.StatContext(ctx, "subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Size() != 4 {
+			t.Errorf("Got %d", info.Size())
+		}
+
+		canceled, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := c.ReadDirContext(canceled, "subdir"); err == nil {
+			t.Error("Expected error for canceled context")
+		}
+
+		if _, err := c.StatContext(canceled, "subdir/1234.bin"); err == nil {
+			t.Error("Expected error for canceled context")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestListDataError(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.Timeout = 200 * time.Millisecond
+
+		// the server never actually receives the command, so the data
+		// connection is opened but nothing is sent on it
+		config.ResponseOverrides = map[string]StubResponse{
+			"LIST subdir": {150, "Opening data connection"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.List("subdir"); err == nil {
+			t.Fatal("Expected error reading listing")
+		}
+
+		// connection should have been discarded rather than reused
+		if c.NumOpenConns() != 0 {
+			t.Errorf("Expected broken connection to be closed, %d open", c.NumOpenConns())
+		}
+
+		if _, err := c.ReadDir("subdir"); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestReadDirEmptyDirError(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ResponseOverrides = map[string]StubResponse{
+			"MLSD subdir": {550, "No files found"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := c.ReadDir("subdir")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(entries) != 0 {
+			t.Errorf("Got %v", entries)
+		}
+
+		if _, err := c.ReadDir("doesnt-exist"); err == nil {
+			t.Error("Expected error for missing directory")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestEmptyDirError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		ftpError{code: 550, msg: "No files found"}:             true,
+		ftpError{code: 450, msg: "No files found"}:             true,
+		ftpError{code: 550, msg: "Directory is empty"}:         true,
+		ftpError{code: 550, msg: "No such file or directory"}:  false,
+		ftpError{code: 550, msg: "Permission denied"}:          false,
+		ftpError{code: 226, msg: "No files found"}:             false,
+		ftpError{err: fmt.Errorf("no files"), msg: "no files"}: false,
+	} {
+		if emptyDirError(err) != expected {
+			t.Errorf("%v: expected %v", err, expected)
+		}
+	}
+}
+
+func TestReadDirStream(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		err = c.ReadDirStream("", func(info os.FileInfo) error {
+			names = append(names, info.Name())
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, []string{"email%40mail.com.txt", "git-ignored", "lorem.txt", "subdir"}) {
+			t.Errorf("Got %v", names)
+		}
+
+		// errors from fn stop the listing
+		stop := fmt.Errorf("stop")
+		var calls int
+		err = c.ReadDirStream("", func(info os.FileInfo) error {
+			calls++
+			return stop
+		})
+
+		if err != stop || calls != 1 {
+			t.Errorf("Got %v after %d calls", err, calls)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestScanAnyLines(t *testing.T) {
+	cases := map[string][]string{
+		"a\r\nb\r\n":     {"a", "b"},
+		"a\nb\n":         {"a", "b"},
+		"a\rb\r":         {"a", "b"},
+		"a\r\nb\nc\rd":   {"a", "b", "c", "d"},
+		"a\r\n\r\nb":     {"a", "", "b"},
+		"no line ending": {"no line ending"},
+		"trailing cr\r":  {"trailing cr"},
+		"":               nil,
+	}
+
+	for input, expected := range cases {
+		// tiny reads to exercise "\r\n" split across reads
+		scanner := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(input)))
+		scanner.Split(scanAnyLines)
+
+		var got []string
+		for scanner.Scan() {
+			got = append(got, scanner.Text())
+		}
+
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%q: got %q", input, got)
+		}
+	}
+}
+
+func TestListingRetries(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var listings int32
+
+	// serve a listing whose data connection is reset partway through the
+	// first time
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+
+		reader := textproto.NewReader(bufio.NewReader(conn))
+		conn.Write([]byte("220 Welcome\r\n"))
+
+		var dataLn net.Listener
+
+		for {
+			line, err := reader.ReadLine()
+			if err != nil {
+				return
+			}
+
+			var reply string
+			switch strings.Fields(line)[0] {
+			case "USER":
+				reply = "331 Need password"
+			case "PASS":
+				reply = "230 Logged in"
+			case "EPSV":
+				dataLn, err = net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					return
+				}
+				port := dataLn.Addr().(*net.TCPAddr).Port
+				reply = "229 Entering Extended Passive Mode (|||" + strconv.Itoa(port) + "|)"
+			case "MLSD":
+				conn.Write([]byte("150 Here it comes\r\n"))
+
+				dc, err := dataLn.Accept()
+				dataLn.Close()
+				if err != nil {
+					return
+				}
+
+				dc.Write([]byte("type=file;size=1; a\r\n"))
+
+				if atomic.AddInt32(&listings, 1) == 1 {
+					dc.(*net.TCPConn).SetLinger(0)
+					dc.Close()
+					reply = "426 Connection closed; transfer aborted"
+					break
+				}
+
+				dc.Write([]byte("type=file;size=2; b\r\n"))
+				dc.Close()
+				reply = "226 Done"
+			case "QUIT":
+				reply = "221 Goodbye"
+			default:
+				reply = "502 Command not implemented"
+			}
+
+			conn.Write([]byte(reply + "\r\n"))
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	config := goftpConfig
+	config.ListingRetries = 1
+
+	c, err := DialConfig(config, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entries, err := c.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Name() != "a" || entries[1].Name() != "b" {
+		t.Errorf("Got %v", entries)
+	}
+
+	if n := atomic.LoadInt32(&listings); n != 2 {
+		t.Errorf("Got %d listings", n)
+	}
+
+	// without ListingRetries, the interrupted listing is an error
+	atomic.StoreInt32(&listings, 0)
+	c.config.ListingRetries = 0
+
+	if _, err := c.ReadDir(""); err == nil {
+		t.Error("Expected error")
+	}
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
@@ -0,0 +1,746 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+/*
+Package ftptest provides an in-memory FTP server for testing code that uses
+goftp, without needing a real FTP server:
+
+	s, err := ftptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.WriteFile("/dir/file.txt", []byte("hello"))
+
+	c, err := goftp.Dial(s.Addr)
+
+The server supports the commands goftp uses for logging in, passive mode
+("EPSV"/"PASV"), listings ("MLSD", "MLST", "LIST") and transfers ("RETR",
+"STOR", "APPE", "REST", "SIZE"), as well as basic file management ("CWD",
+"PWD", "MKD", "RMD", "DELE", "RNFR"/"RNTO"). Active mode is not supported.
+*/
+package ftptest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	pathpkg "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MLST timestamp format (see RFC 3659).
+const timeFormat = "20060102150405"
+
+// How long to wait for the client to connect to a passive data port.
+const dataTimeout = 5 * time.Second
+
+// Server is an FTP server listening on a local port, serving files from
+// memory. Its methods are safe to call while clients are connected.
+type Server struct {
+	// Address the server is listening on, e.g. "127.0.0.1:41234".
+	Addr string
+
+	// If set, clients must log in with this user and password. Otherwise
+	// any credentials are accepted.
+	User     string
+	Password string
+
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	conns   map[net.Conn]bool
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// A file or directory.
+type entry struct {
+	dir   bool
+	data  []byte
+	mtime time.Time
+}
+
+// NewServer starts a server on a random port on 127.0.0.1, with an empty
+// root directory. Call Close to stop it.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		entries: map[string]*entry{
+			"/": {dir: true, mtime: time.Now()},
+		},
+		conns: make(map[net.Conn]bool),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Close stops the server, closing any client connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// WriteFile creates or replaces the file at (absolute) "path", creating
+// parent directories as needed.
+func (s *Server) WriteFile(path string, data []byte) {
+	path = pathpkg.Clean("/" + path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mkdirAll(pathpkg.Dir(path))
+	s.entries[path] = &entry{data: append([]byte(nil), data...), mtime: time.Now()}
+}
+
+// ReadFile returns the contents of the file at "path", and whether it
+// exists.
+func (s *Server) ReadFile(path string) ([]byte, bool) {
+	path = pathpkg.Clean("/" + path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entries[path]
+	if e == nil || e.dir {
+		return nil, false
+	}
+
+	return append([]byte(nil), e.data...), true
+}
+
+// Mkdir creates the directory at "path" along with any missing parents.
+func (s *Server) Mkdir(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mkdirAll(pathpkg.Clean("/" + path))
+}
+
+// Remove deletes the file or directory (and its contents) at "path".
+func (s *Server) Remove(path string) {
+	path = pathpkg.Clean("/" + path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for p := range s.entries {
+		if p != "/" && (p == path || strings.HasPrefix(p, path+"/")) {
+			delete(s.entries, p)
+		}
+	}
+}
+
+// s.mu must be held.
+func (s *Server) mkdirAll(path string) {
+	for p := path; ; p = pathpkg.Dir(p) {
+		if e := s.entries[p]; e == nil || !e.dir {
+			s.entries[p] = &entry{dir: true, mtime: time.Now()}
+		}
+		if p == "/" {
+			return
+		}
+	}
+}
+
+// Names of the entries in directory "dir", sorted. s.mu must be held.
+func (s *Server) children(dir string) []string {
+	var names []string
+	for p := range s.entries {
+		if p != "/" && pathpkg.Dir(p) == dir {
+			names = append(names, pathpkg.Base(p))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		if !s.track(conn) {
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+
+			sess := &session{
+				server: s,
+				conn:   conn,
+				reader: textproto.NewReader(bufio.NewReader(conn)),
+				writer: textproto.NewWriter(bufio.NewWriter(conn)),
+				cwd:    "/",
+			}
+			sess.run()
+		}()
+	}
+}
+
+// Record an open connection so Close can close it. Returns false (having
+// closed conn) if the server is closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		conn.Close()
+		return false
+	}
+
+	s.conns[conn] = true
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// State of one control connection.
+type session struct {
+	server *Server
+	conn   net.Conn
+	reader *textproto.Reader
+	writer *textproto.Writer
+
+	user     string
+	loggedIn bool
+	cwd      string
+
+	// from "REST", applies to the next transfer (allowing "EPSV"/"PASV" in
+	// between, as clients send them after "REST")
+	restOffset int64
+
+	// from "RNFR", applies to the next "RNTO"
+	renameFrom string
+
+	// passive data port opened by "EPSV"/"PASV"
+	dataListener net.Listener
+}
+
+func (sess *session) run() {
+	defer sess.conn.Close()
+	defer sess.closeDataListener()
+
+	sess.reply(220, "ftptest ready")
+
+	for {
+		line, err := sess.reader.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg := line, ""
+		if space := strings.IndexByte(line, ' '); space != -1 {
+			cmd, arg = line[:space], line[space+1:]
+		}
+		cmd = strings.ToUpper(cmd)
+
+		if cmd == "QUIT" {
+			sess.reply(221, "Goodbye")
+			return
+		}
+
+		sess.handle(cmd, arg)
+	}
+}
+
+func (sess *session) reply(code int, msg string) {
+	sess.writer.PrintfLine("%d %s", code, msg)
+}
+
+// Send a multi-line reply with the given lines between the first and last.
+func (sess *session) replyLines(code int, first string, lines []string, last string) {
+	sess.writer.PrintfLine("%d-%s", code, first)
+	for _, line := range lines {
+		sess.writer.PrintfLine(" %s", line)
+	}
+	sess.writer.PrintfLine("%d %s", code, last)
+}
+
+// Absolute, cleaned version of a path argument.
+func (sess *session) resolve(arg string) string {
+	if strings.HasPrefix(arg, "/") {
+		return pathpkg.Clean(arg)
+	}
+	return pathpkg.Join(sess.cwd, arg)
+}
+
+func (sess *session) handle(cmd, arg string) {
+	switch cmd {
+	case "USER":
+		sess.user = arg
+		sess.loggedIn = false
+		sess.reply(331, "Password required")
+		return
+	case "PASS":
+		s := sess.server
+		if s.User != "" && (sess.user != s.User || arg != s.Password) {
+			sess.reply(530, "Login incorrect")
+			return
+		}
+		sess.loggedIn = true
+		sess.reply(230, "Logged in")
+		return
+	case "FEAT":
+		sess.replyLines(211, "Features:", []string{
+			"EPSV",
+			"MLST type*;size*;modify*;",
+			"REST STREAM",
+			"SIZE",
+			"UTF8",
+		}, "End")
+		return
+	case "NOOP":
+		sess.reply(200, "OK")
+		return
+	case "OPTS":
+		sess.reply(200, "OK")
+		return
+	}
+
+	if !sess.loggedIn {
+		sess.reply(530, "Not logged in")
+		return
+	}
+
+	s := sess.server
+
+	switch cmd {
+	case "SYST":
+		sess.reply(215, "UNIX Type: L8")
+	case "TYPE":
+		sess.reply(200, "Type set to "+arg)
+	case "PWD":
+		sess.reply(257, fmt.Sprintf(`"%s" is the current directory`, strings.Replace(sess.cwd, `"`, `""`, -1)))
+	case "CWD":
+		path := sess.resolve(arg)
+		s.mu.Lock()
+		e := s.entries[path]
+		s.mu.Unlock()
+		if e == nil || !e.dir {
+			sess.reply(550, "No such directory")
+			return
+		}
+		sess.cwd = path
+		sess.reply(250, "Directory changed")
+	case "CDUP":
+		sess.cwd = pathpkg.Dir(sess.cwd)
+		sess.reply(250, "Directory changed")
+	case "MKD":
+		path := sess.resolve(arg)
+		s.mu.Lock()
+		parent := s.entries[pathpkg.Dir(path)]
+		ok := s.entries[path] == nil && parent != nil && parent.dir
+		if ok {
+			s.entries[path] = &entry{dir: true, mtime: time.Now()}
+		}
+		s.mu.Unlock()
+		if !ok {
+			sess.reply(550, "Can't create directory")
+			return
+		}
+		sess.reply(257, fmt.Sprintf(`"%s" created`, strings.Replace(path, `"`, `""`, -1)))
+	case "RMD":
+		path := sess.resolve(arg)
+		s.mu.Lock()
+		e := s.entries[path]
+		ok := e != nil && e.dir && path != "/" && len(s.children(path)) == 0
+		if ok {
+			delete(s.entries, path)
+		}
+		s.mu.Unlock()
+		if !ok {
+			sess.reply(550, "Can't remove directory")
+			return
+		}
+		sess.reply(250, "Directory removed")
+	case "DELE":
+		path := sess.resolve(arg)
+		s.mu.Lock()
+		e := s.entries[path]
+		ok := e != nil && !e.dir
+		if ok {
+			delete(s.entries, path)
+		}
+		s.mu.Unlock()
+		if !ok {
+			sess.reply(550, "No such file")
+			return
+		}
+		sess.reply(250, "File deleted")
+	case "RNFR":
+		path := sess.resolve(arg)
+		s.mu.Lock()
+		e := s.entries[path]
+		s.mu.Unlock()
+		if e == nil || path == "/" {
+			sess.reply(550, "No such file or directory")
+			return
+		}
+		sess.renameFrom = path
+		sess.reply(350, "Ready for RNTO")
+	case "RNTO":
+		sess.rename(sess.resolve(arg))
+	case "SIZE":
+		path := sess.resolve(arg)
+		s.mu.Lock()
+		e := s.entries[path]
+		s.mu.Unlock()
+		if e == nil || e.dir {
+			sess.reply(550, "No such file")
+			return
+		}
+		sess.reply(213, strconv.Itoa(len(e.data)))
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || offset < 0 {
+			sess.reply(501, "Invalid offset")
+			return
+		}
+		sess.restOffset = offset
+		sess.reply(350, fmt.Sprintf("Restarting at %d", offset))
+	case "EPSV", "PASV":
+		sess.passive(cmd)
+	case "MLST":
+		path := sess.resolve(arg)
+		s.mu.Lock()
+		e := s.entries[path]
+		var fact string
+		if e != nil {
+			fact = mlstEntry(e, path)
+		}
+		s.mu.Unlock()
+		if e == nil {
+			sess.reply(550, "No such file or directory")
+			return
+		}
+		sess.replyLines(250, "Listing "+path, []string{fact}, "End")
+	case "MLSD", "LIST", "NLST":
+		sess.list(cmd, arg)
+	case "RETR":
+		offset := sess.restOffset
+		sess.restOffset = 0
+		sess.retrieve(sess.resolve(arg), offset)
+	case "STOR", "APPE":
+		offset := sess.restOffset
+		sess.restOffset = 0
+		sess.store(cmd, sess.resolve(arg), offset)
+	default:
+		sess.reply(502, "Command not implemented")
+	}
+}
+
+func (sess *session) rename(to string) {
+	from := sess.renameFrom
+	sess.renameFrom = ""
+
+	if from == "" {
+		sess.reply(503, "RNFR required first")
+		return
+	}
+
+	s := sess.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parent := s.entries[pathpkg.Dir(to)]
+	if s.entries[from] == nil || parent == nil || !parent.dir || strings.HasPrefix(to, from+"/") {
+		sess.reply(550, "Can't rename")
+		return
+	}
+
+	if e := s.entries[to]; e != nil && e.dir {
+		sess.reply(550, "Destination is a directory")
+		return
+	}
+
+	for p, e := range s.entries {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			delete(s.entries, p)
+			s.entries[to+strings.TrimPrefix(p, from)] = e
+		}
+	}
+
+	sess.reply(250, "Renamed")
+}
+
+func (sess *session) closeDataListener() {
+	if sess.dataListener != nil {
+		sess.dataListener.Close()
+		sess.dataListener = nil
+	}
+}
+
+// Open a passive data port and tell the client about it.
+func (sess *session) passive(cmd string) {
+	sess.closeDataListener()
+
+	host, _, _ := net.SplitHostPort(sess.conn.LocalAddr().String())
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		sess.reply(425, "Can't open data connection")
+		return
+	}
+	sess.dataListener = listener
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if cmd == "EPSV" {
+		sess.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		sess.closeDataListener()
+		sess.reply(522, "Use EPSV for IPv6")
+		return
+	}
+
+	sess.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xFF))
+}
+
+// Accept the client's connection to the passive data port, after sending
+// the preliminary reply.
+func (sess *session) openData() (net.Conn, bool) {
+	listener := sess.dataListener
+	sess.dataListener = nil
+
+	if listener == nil {
+		sess.reply(425, "Use EPSV or PASV first")
+		return nil, false
+	}
+
+	defer listener.Close()
+
+	sess.reply(150, "Opening data connection")
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(dataTimeout))
+	conn, err := listener.Accept()
+	if err != nil || !sess.server.track(conn) {
+		sess.reply(425, "Can't open data connection")
+		return nil, false
+	}
+
+	return &trackedConn{Conn: conn, server: sess.server}, true
+}
+
+// Data connection that stops being tracked by the server when closed.
+type trackedConn struct {
+	net.Conn
+	server *Server
+}
+
+func (c *trackedConn) Close() error {
+	c.server.untrack(c.Conn)
+	return c.Conn.Close()
+}
+
+func (sess *session) list(cmd, arg string) {
+	s := sess.server
+
+	// ignore options like "-a"
+	if strings.HasPrefix(arg, "-") {
+		arg = ""
+	}
+	path := sess.resolve(arg)
+
+	s.mu.Lock()
+	e := s.entries[path]
+	var lines []string
+	if e != nil && e.dir {
+		for _, name := range s.children(path) {
+			child := pathpkg.Join(path, name)
+			lines = append(lines, listEntry(cmd, s.entries[child], name))
+		}
+	} else if e != nil && cmd != "MLSD" {
+		lines = append(lines, listEntry(cmd, e, pathpkg.Base(path)))
+	}
+	s.mu.Unlock()
+
+	if e == nil || cmd == "MLSD" && !e.dir {
+		sess.closeDataListener()
+		sess.reply(550, "No such directory")
+		return
+	}
+
+	dc, ok := sess.openData()
+	if !ok {
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line + "\r\n")
+	}
+
+	_, err := dc.Write(buf.Bytes())
+	dc.Close()
+
+	if err != nil {
+		sess.reply(426, "Transfer aborted")
+		return
+	}
+
+	sess.reply(226, "Transfer complete")
+}
+
+func listEntry(cmd string, e *entry, name string) string {
+	switch cmd {
+	case "MLSD":
+		return mlstEntry(e, name)
+	case "NLST":
+		return name
+	}
+
+	mode, size := "-rw-r--r--", len(e.data)
+	if e.dir {
+		mode, size = "drwxr-xr-x", 0
+	}
+
+	mtime := e.mtime.UTC().Format("Jan _2  2006")
+	if time.Since(e.mtime) < 180*24*time.Hour {
+		mtime = e.mtime.UTC().Format("Jan _2 15:04")
+	}
+
+	return fmt.Sprintf("%s 1 ftptest ftptest %d %s %s", mode, size, mtime, name)
+}
+
+func mlstEntry(e *entry, name string) string {
+	modify := e.mtime.UTC().Format(timeFormat)
+	if e.dir {
+		return fmt.Sprintf("type=dir;modify=%s; %s", modify, name)
+	}
+	return fmt.Sprintf("type=file;size=%d;modify=%s; %s", len(e.data), modify, name)
+}
+
+func (sess *session) retrieve(path string, offset int64) {
+	s := sess.server
+
+	s.mu.Lock()
+	e := s.entries[path]
+	var data []byte
+	if e != nil && !e.dir && offset <= int64(len(e.data)) {
+		data = e.data[offset:]
+	}
+	s.mu.Unlock()
+
+	if e == nil || e.dir {
+		sess.closeDataListener()
+		sess.reply(550, "No such file")
+		return
+	}
+
+	if offset > int64(len(e.data)) {
+		sess.closeDataListener()
+		sess.reply(554, "Invalid REST offset")
+		return
+	}
+
+	dc, ok := sess.openData()
+	if !ok {
+		return
+	}
+
+	_, err := dc.Write(data)
+	dc.Close()
+
+	if err != nil {
+		sess.reply(426, "Transfer aborted")
+		return
+	}
+
+	sess.reply(226, "Transfer complete")
+}
+
+func (sess *session) store(cmd, path string, offset int64) {
+	s := sess.server
+
+	s.mu.Lock()
+	parent := s.entries[pathpkg.Dir(path)]
+	e := s.entries[path]
+	s.mu.Unlock()
+
+	if parent == nil || !parent.dir || e != nil && e.dir {
+		sess.closeDataListener()
+		sess.reply(553, "Can't store file")
+		return
+	}
+
+	dc, ok := sess.openData()
+	if !ok {
+		return
+	}
+
+	data, err := ioutil.ReadAll(dc)
+	dc.Close()
+
+	s.mu.Lock()
+	var existing []byte
+	if e := s.entries[path]; e != nil && !e.dir {
+		existing = e.data
+	}
+
+	switch {
+	case cmd == "APPE":
+		data = append(append([]byte(nil), existing...), data...)
+	case offset > 0:
+		if offset > int64(len(existing)) {
+			offset = int64(len(existing))
+		}
+		data = append(append([]byte(nil), existing[:offset]...), data...)
+	}
+
+	// keep what was received even if the transfer was cut short, so it can
+	// be resumed
+	s.entries[path] = &entry{data: data, mtime: time.Now()}
+	s.mu.Unlock()
+
+	if err != nil && err != io.EOF {
+		sess.reply(426, "Transfer aborted")
+		return
+	}
+
+	sess.reply(226, "Transfer complete")
+}
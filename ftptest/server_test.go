@@ -0,0 +1,203 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftptest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/secsy/goftp"
+)
+
+func TestServer(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.WriteFile("/subdir/1234.bin", []byte{1, 2, 3, 4})
+
+	c, err := goftp.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("subdir/1234.bin", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+		t.Errorf("Got %v", buf.Bytes())
+	}
+
+	buf.Reset()
+	if err := c.RetrieveFrom("subdir/1234.bin", buf, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal([]byte{3, 4}, buf.Bytes()) {
+		t.Errorf("Got %v", buf.Bytes())
+	}
+
+	if _, err := c.Mkdir("new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Store("new/file", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := s.ReadFile("/new/file"); !ok || string(got) != "hello" {
+		t.Errorf("Got %q", got)
+	}
+
+	if err := c.Rename("new/file", "subdir/renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := c.ReadDir("subdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Name() != "1234.bin" || entries[1].Name() != "renamed" || entries[1].Size() != 5 {
+		t.Errorf("Got %v", entries)
+	}
+
+	info, err := c.Stat("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.IsDir() {
+		t.Errorf("Got %v", info)
+	}
+
+	if err := c.Rmdir("new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Delete("subdir/renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.ReadFile("/subdir/renamed"); ok {
+		t.Error("Expected file to be deleted")
+	}
+
+	err = c.Delete("subdir/renamed")
+	if fe, ok := err.(goftp.Error); !ok || fe.Code() != 550 {
+		t.Errorf("Got %v", err)
+	}
+}
+
+func TestServerLogin(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.User = "goftp"
+	s.Password = "rocks"
+
+	c, err := goftp.DialConfig(goftp.Config{User: "goftp", Password: "wrong"}, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Getwd()
+	if fe, ok := err.(goftp.Error); !ok || fe.Code() != 530 {
+		t.Errorf("Got %v", err)
+	}
+	c.Close()
+
+	c, err = goftp.DialConfig(goftp.Config{User: "goftp", Password: "rocks"}, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dir, err := c.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dir != "/" {
+		t.Errorf("Got %s", dir)
+	}
+}
+
+func TestResponseOverrides(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.WriteFile("/foo", []byte("foo"))
+
+	config := goftp.Config{
+		ResponseOverrides: map[string]goftp.StubResponse{
+			"DELE foo": {Code: 450, Message: "Try again later"},
+		},
+	}
+
+	c, err := goftp.DialConfig(config, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Delete("foo")
+	if fe, ok := err.(goftp.Error); !ok || fe.Code() != 450 || fe.Message() != "Try again later" {
+		t.Errorf("Got %v", err)
+	}
+
+	if _, ok := s.ReadFile("/foo"); !ok {
+		t.Error("File shouldn't have been deleted")
+	}
+}
+
+func TestServerEmptyFile(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.WriteFile("/empty", nil)
+
+	c, err := goftp.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := new(bytes.Buffer)
+	if err := c.Retrieve("empty", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("Got %v", buf.Bytes())
+	}
+
+	// appending nothing to a new file creates an empty file
+	if err := c.Append("new", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Retrieve("new", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("Got %v", buf.Bytes())
+	}
+}
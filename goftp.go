@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strings"
 )
 
 // Dial creates an FTP client using the default config. See DialConfig for
@@ -25,14 +26,51 @@ func Dial(hosts ...string) (*Client, error) {
 // Hostnames will be expanded to all the IP addresses they resolve to. The
 // client's connection pool will pick from all the addresses in a round-robin
 // fashion. If you specify multiple hosts, they should be identical mirrors of
-// each other.
+// each other. No connections are opened until they are needed, unless
+// Config.EagerConnect is set.
 func DialConfig(config Config, hosts ...string) (*Client, error) {
 	expandedHosts, err := lookupHosts(hosts, config.IPv6Lookup)
 	if err != nil {
 		return nil, err
 	}
 
-	return newClient(config, expandedHosts), nil
+	client := newClient(config, expandedHosts)
+
+	if config.EagerConnect {
+		pconn, err := client.getIdleConn()
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		client.returnConn(pconn)
+	}
+
+	return client, nil
+}
+
+// DialWithConn creates an FTP client that uses conn as its control
+// connection instead of dialing one, e.g. to tunnel over an SSH-forwarded
+// socket or to test against an in-memory pipe. The server's greeting is read
+// and the client logs in before DialWithConn returns. The resulting Client
+// has a single connection (ConnectionsPerHost is ignored) which can't be
+// reopened: once it breaks or is closed, all operations fail. Data
+// connections are still opened normally (see Config.DialContext and
+// Config.RewritePassiveAddr to route them elsewhere).
+func DialWithConn(config Config, conn net.Conn) (*Client, error) {
+	config.ConnectionsPerHost = 1
+
+	client := newClient(config, []string{conn.RemoteAddr().String()})
+	client.singleConn = true
+	client.givenConn = conn
+
+	pconn, err := client.getIdleConn()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.returnConn(pconn)
+
+	return client, nil
 }
 
 var hasPort = regexp.MustCompile(`^[^:]+:\d+$|\]:\d+$`)
@@ -43,8 +81,9 @@ func lookupHosts(hosts []string, ipv6Lookup bool) ([]string, error) {
 	}
 
 	var (
-		ret  []string
-		ipv6 []string
+		ret        []string
+		ipv6       []string
+		lookupErrs []error
 	)
 
 	for i, host := range hosts {
@@ -63,9 +102,10 @@ func lookupHosts(hosts []string, ipv6Lookup bool) ([]string, error) {
 			// not an IP, must be hostname
 			ips, err := net.LookupIP(hostnameOrIP)
 
-			// consider not returning error if other hosts in the list work
+			// only an error if none of the other hosts work either
 			if err != nil {
-				return nil, fmt.Errorf(`error resolving host "%s": %s`, hostnameOrIP, err)
+				lookupErrs = append(lookupErrs, fmt.Errorf(`error resolving host "%s": %s`, hostnameOrIP, err))
+				continue
 			}
 
 			for _, ip := range ips {
@@ -85,5 +125,29 @@ func lookupHosts(hosts []string, ipv6Lookup bool) ([]string, error) {
 		return ipv6, nil
 	}
 
+	if len(ret) == 0 {
+		return nil, LookupError{Errors: lookupErrs}
+	}
+
 	return ret, nil
 }
+
+// LookupError is returned by Dial and DialConfig when none of the given
+// hosts could be resolved. If at least one host resolves, hosts that fail
+// to resolve are ignored.
+type LookupError struct {
+	// The resolution error for each host.
+	Errors []error
+}
+
+func (e LookupError) Error() string {
+	if len(e.Errors) == 0 {
+		return "no hosts resolved"
+	}
+
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
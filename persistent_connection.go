@@ -6,12 +6,20 @@ package goftp
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/textproto"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -31,18 +39,34 @@ type RawConn interface {
 	// data command since the server sends an unsolicited response you must read.
 	ReadResponse() (int, string, error)
 
+	// Abort an in-progress data command (e.g. a RETR or LIST whose data
+	// connection is still open) by sending "ABOR" preceded by the Telnet
+	// "Interrupt Process" and "Data Mark" signals, as described in RFC 959.
+	// Abort consumes the server's reply to the aborted command (typically 426,
+	// or 226 if it had already finished) and its reply to "ABOR" (226),
+	// leaving the connection ready for the next command. Call Abort instead
+	// of reading the data command's final response with ReadResponse.
+	Abort() error
+
 	// Close the control and data connection, if open.
 	Close() error
 }
 
 // Represents a single connection to an FTP server.
 type persistentConn struct {
+	// guards writes to controlConn, dataConn and activeListener, which
+	// setContext's goroutine closes when its context is done
+	connMu sync.Mutex
+
 	// control socket
 	controlConn net.Conn
 
 	// data socket (tracked so we can close it on client.Close())
 	dataConn net.Conn
 
+	// listening for an active data connection the server hasn't made yet
+	activeListener *net.TCPListener
+
 	// control socket read/write helpers
 	reader *textproto.Reader
 	writer *textproto.Writer
@@ -50,9 +74,15 @@ type persistentConn struct {
 	config Config
 	t0     time.Time
 
+	// Client.credGen when this connection logged in
+	credGen int
+
 	// has this connection encountered an unrecoverable error
 	broken bool
 
+	// a data command's final reply hasn't been read yet
+	transferPending bool
+
 	// index of this connection (used for logging context and
 	// round-roubin host selection)
 	idx int
@@ -60,12 +90,39 @@ type persistentConn struct {
 	// map of ftp features available on server
 	features map[string]string
 
-	// remember EPSV support
+	// remember EPSV support (or that its data connections don't work)
 	epsvNotSupported bool
 
+	// the address in PASV replies couldn't be connected to, but the control
+	// connection's host could
+	pasvAddressUnusable bool
+
+	// using the non-preferred mode of a PassivePreferred or ActivePreferred
+	// TransferMode since the preferred mode failed
+	dataModeFallback bool
+
 	// tracks the current type (e.g. ASCII/Image) of connection
 	currentType string
 
+	// counters shared with the Client
+	stats *clientStats
+
+	// shared with the Client, nil unless Config.CaptureResponses is set
+	responses *responseLog
+
+	// working directory set via Client.ChangeDir (empty if never changed)
+	cwd string
+
+	// when this connection was last returned to the pool
+	lastUsed time.Time
+
+	// context of the operation currently using this connection, if any
+	ctx context.Context
+
+	// reopens the control connection after it breaks (nil if this
+	// connection can't be reopened transparently)
+	reconnect func() error
+
 	host string
 }
 
@@ -85,8 +142,44 @@ func (pconn *persistentConn) Close() error {
 	return pconn.close()
 }
 
+func (pconn *persistentConn) Abort() error {
+	return pconn.abort()
+}
+
+// Telnet "Interrupt Process" and "Data Mark" sequences sent ahead of ABOR
+const telnetIPDM = "\xff\xf4\xff\xf2"
+
+func (pconn *persistentConn) abort() error {
+	pending := pconn.transferPending
+
+	code, msg, err := pconn.sendCommandLine("ABOR")
+	if err != nil {
+		return err
+	}
+
+	// if a data command was in progress, its reply comes first (426, or 226
+	// if it had already finished), then ABOR's
+	if pending {
+		code, msg, err = pconn.readResponse()
+		if err != nil {
+			return err
+		}
+
+		pconn.debug("got %d-%s", code, msg)
+	}
+
+	if code != replyClosingDataConnection && code != replyDataConnectionOpen {
+		return ftpError{code: code, msg: msg}
+	}
+
+	return nil
+}
+
 func (pconn *persistentConn) setControlConn(conn net.Conn) {
+	pconn.connMu.Lock()
 	pconn.controlConn = conn
+	pconn.connMu.Unlock()
+
 	pconn.reader = textproto.NewReader(bufio.NewReader(conn))
 	pconn.writer = textproto.NewWriter(bufio.NewWriter(conn))
 }
@@ -100,6 +193,8 @@ func (pconn *persistentConn) close() error {
 		pconn.dataConn.Close()
 	}
 
+	pconn.closeActiveListener()
+
 	if pconn.controlConn != nil {
 		return pconn.controlConn.Close()
 	}
@@ -107,6 +202,114 @@ func (pconn *persistentConn) close() error {
 	return nil
 }
 
+// Stop listening for an active data connection, e.g. because the transfer
+// command failed so the server won't connect.
+func (pconn *persistentConn) closeActiveListener() {
+	if pconn.activeListener == nil {
+		return
+	}
+
+	if err := pconn.activeListener.Close(); err != nil {
+		pconn.debug("error closing data connection listener: %s", err)
+	}
+
+	pconn.connMu.Lock()
+	pconn.activeListener = nil
+	pconn.connMu.Unlock()
+}
+
+// Track the data connection, so close and interrupt can close it.
+func (pconn *persistentConn) setDataConn(dc net.Conn) net.Conn {
+	pconn.connMu.Lock()
+	defer pconn.connMu.Unlock()
+
+	if dc == nil {
+		pconn.dataConn = nil
+	} else {
+		pconn.dataConn = &dataConn{
+			Conn:    dc,
+			Timeout: pconn.config.DataTimeout,
+		}
+	}
+
+	return pconn.dataConn
+}
+
+// Close the connection's sockets to interrupt whatever is using them. This
+// runs on setContext's goroutine, so unlike close it doesn't log or modify
+// the connection.
+func (pconn *persistentConn) interrupt() {
+	pconn.connMu.Lock()
+	defer pconn.connMu.Unlock()
+
+	if pconn.dataConn != nil {
+		pconn.dataConn.Close()
+	}
+
+	if pconn.activeListener != nil {
+		pconn.activeListener.Close()
+	}
+
+	if pconn.controlConn != nil {
+		pconn.controlConn.Close()
+	}
+}
+
+// Politely end the session before closing the connection.
+func (pconn *persistentConn) quit() {
+	if pconn.broken {
+		return
+	}
+
+	if err := pconn.sendCommandExpected(replyClosingControlConnection, "QUIT"); err != nil {
+		pconn.debug("error sending QUIT: %s", err)
+	}
+
+	// connection is no good after QUIT, regardless of the response
+	pconn.broken = true
+}
+
+// setContext ties the connection to ctx for the duration of an operation.
+// Control connection deadlines are capped at ctx's deadline, and if ctx is
+// done before the returned function is called, the connection is closed
+// (interrupting any blocked reads or writes) and marked broken.
+func (pconn *persistentConn) setContext(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	pconn.ctx = ctx
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pconn.interrupt()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		pconn.ctx = nil
+		if ctx.Err() != nil {
+			pconn.debug("interrupted connection: %s", ctx.Err())
+			pconn.broken = true
+		}
+	}
+}
+
+// Deadline for the next control connection read or write.
+func (pconn *persistentConn) controlDeadline() time.Time {
+	deadline := time.Now().Add(pconn.config.Timeout)
+	if pconn.ctx != nil {
+		if ctxDeadline, ok := pconn.ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			return ctxDeadline
+		}
+	}
+	return deadline
+}
+
 func (pconn *persistentConn) sendCommandExpected(expected int, f string, args ...interface{}) error {
 	code, msg, err := pconn.sendCommand(f, args...)
 	if err != nil {
@@ -128,25 +331,131 @@ func (pconn *persistentConn) sendCommandExpected(expected int, f string, args ..
 	return nil
 }
 
+// Commands that are safe to send again if the control connection broke
+// before their reply was read. "STAT" is only replayed without an argument,
+// since "STAT path" sends a listing.
+var replayableCommands = map[string]bool{
+	"PWD":  true,
+	"FEAT": true,
+	"STAT": true,
+	"SIZE": true,
+	"MLST": true,
+}
+
 func (pconn *persistentConn) sendCommand(f string, args ...interface{}) (int, string, error) {
 	cmd := fmt.Sprintf(f, args...)
 
+	code, msg, err := pconn.sendCommandLine(cmd)
+	if err == nil || !pconn.broken || pconn.reconnect == nil {
+		return code, msg, err
+	}
+
+	// the connection was interrupted on purpose (see setContext)
+	if pconn.ctx != nil && pconn.ctx.Err() != nil {
+		return 0, "", contextError(pconn.ctx.Err())
+	}
+
+	verb, arg := cmd, ""
+	if i := strings.IndexByte(cmd, ' '); i >= 0 {
+		verb, arg = cmd[:i], cmd[i+1:]
+	}
+
+	verb = strings.ToUpper(verb)
+	if !replayableCommands[verb] || (verb == "STAT" && arg != "") {
+		return code, msg, err
+	}
+
+	// the new connection starts out in ASCII mode, which changes the
+	// results of e.g. "SIZE"
+	typ := pconn.currentType
+
+	// only try once; the new connection's setup commands mustn't recurse
+	reconnect := pconn.reconnect
+	pconn.reconnect = nil
+	defer func() { pconn.reconnect = reconnect }()
+
+	if reconnectErr := reconnect(); reconnectErr != nil {
+		pconn.debug("error reconnecting: %s", reconnectErr)
+		return code, msg, err
+	}
+
+	atomic.AddInt64(&pconn.stats.reconnects, 1)
+
+	if err := pconn.setType(typ); err != nil {
+		return 0, "", err
+	}
+
+	pconn.debug(`replaying command "%s"`, cmd)
+
+	return pconn.sendCommandLine(cmd)
+}
+
+func (pconn *persistentConn) sendCommandLine(cmd string) (code int, msg string, err error) {
 	logName := cmd
 	if strings.HasPrefix(cmd, "PASS") {
 		logName = "PASS ******"
+	} else if strings.HasPrefix(cmd, "ACCT") {
+		logName = "ACCT ******"
 	}
 
-	pconn.debug("sending command %s", logName)
+	pconn.debugText("sending command %s", logName)
+
+	if pconn.config.CommandHook != nil || pconn.responses != nil || pconn.config.Slog != nil {
+		start := time.Now()
+
+		defer func() {
+			gotCode, gotMsg := code, msg
+			if err != nil {
+				gotCode, gotMsg = 0, err.Error()
+			}
 
-	if pconn.config.stubResponses != nil {
-		if stub, found := pconn.config.stubResponses[cmd]; found {
-			pconn.debug("got stub response %d-%s", stub.code, stub.msg)
-			return stub.code, stub.msg, nil
+			if pconn.config.Slog != nil {
+				attrs := []interface{}{
+					"conn", pconn.idx,
+					"command", logName,
+					"code", gotCode,
+					"duration", time.Since(start),
+				}
+				if err != nil {
+					attrs = append(attrs, "error", gotMsg)
+				}
+				pconn.config.Slog.Debug("command", attrs...)
+			}
+
+			if pconn.config.CommandHook != nil {
+				pconn.config.CommandHook(logName, gotCode, gotMsg)
+			}
+
+			if pconn.responses != nil {
+				pconn.responses.add(CommandResponse{Command: logName, Code: gotCode, Message: gotMsg})
+			}
+		}()
+	}
+
+	if pconn.config.ResponseOverrides != nil {
+		if stub, found := pconn.config.ResponseOverrides[cmd]; found {
+			pconn.debug("got stub response %d-%s", stub.Code, stub.Message)
+			return stub.Code, stub.Message, nil
 		}
 	}
 
-	pconn.controlConn.SetWriteDeadline(time.Now().Add(pconn.config.Timeout))
-	err := pconn.writer.PrintfLine("%s", cmd)
+	line := cmd
+	if pconn.config.PathEncoding != nil {
+		line, err = pconn.config.PathEncoding.Encode(cmd)
+		if err != nil {
+			return 0, "", ftpError{err: fmt.Errorf(`error encoding command "%s": %s`, logName, err)}
+		}
+	}
+
+	// Telnet IP and DM make the server notice ABOR during a transfer
+	if cmd == "ABOR" {
+		line = telnetIPDM + line
+	}
+
+	pconn.controlConn.SetWriteDeadline(pconn.controlDeadline())
+	err = pconn.writer.PrintfLine("%s", line)
+
+	atomic.AddInt64(&pconn.stats.commandsSent, 1)
 
 	if err != nil {
 		pconn.broken = true
@@ -157,19 +466,19 @@ func (pconn *persistentConn) sendCommand(f string, args ...interface{}) (int, st
 		}
 	}
 
-	code, msg, err := pconn.readResponse()
+	code, msg, err = pconn.readResponse()
 	if err != nil {
 		return 0, "", err
 	}
 
-	pconn.debug("got %d-%s", code, msg)
+	pconn.debugText("got %d-%s", code, msg)
 
 	return code, msg, err
 }
 
 func (pconn *persistentConn) readResponse() (int, string, error) {
-	pconn.controlConn.SetReadDeadline(time.Now().Add(pconn.config.Timeout))
-	code, msg, err := pconn.reader.ReadResponse(0)
+	pconn.controlConn.SetReadDeadline(pconn.controlDeadline())
+	code, msg, err := pconn.readCodeLines()
 	if err != nil {
 		pconn.broken = true
 		pconn.debug("error reading response: %s", err)
@@ -177,11 +486,193 @@ func (pconn *persistentConn) readResponse() (int, string, error) {
 			err:       fmt.Errorf("error reading response: %s", err),
 			temporary: true,
 		}
+	} else {
+		pconn.transferPending = code/100 == 1
+
+		if code == replyServiceNotAvailable {
+			// server is closing the control connection
+			pconn.broken = true
+		}
 	}
-	return code, msg, err
+	return code, pconn.decode(msg), err
+}
+
+// Send "NOOP" on the control connection every interval until the returned
+// function is called, to stop idle control connections from being dropped
+// during long transfers. Replies aren't read here; the returned function
+// reports how many NOOPs were sent so readTransferResponse can consume
+// their replies.
+func (pconn *persistentConn) startKeepAlive(interval time.Duration) func() (int, error) {
+	type result struct {
+		sent int
+		err  error
+	}
+
+	stop := make(chan struct{})
+	done := make(chan result)
+
+	go func() {
+		var res result
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				done <- res
+				return
+			case <-ticker.C:
+				if res.err != nil {
+					continue
+				}
+
+				pconn.debug("sending keep-alive NOOP")
+				pconn.controlConn.SetWriteDeadline(pconn.controlDeadline())
+				if err := pconn.writer.PrintfLine("NOOP"); err != nil {
+					res.err = ftpError{
+						err:       fmt.Errorf("error writing keep-alive NOOP: %s", err),
+						temporary: true,
+					}
+					continue
+				}
+
+				atomic.AddInt64(&pconn.stats.commandsSent, 1)
+				res.sent++
+			}
+		}
+	}()
+
+	return func() (int, error) {
+		close(stop)
+		res := <-done
+		return res.sent, res.err
+	}
+}
+
+// Read the final reply to a transfer command, along with the replies to
+// any keep-alive NOOPs sent during the transfer. Servers may answer the
+// NOOPs before or after the transfer completes, so the transfer's reply is
+// taken to be the first reply that isn't a NOOP's 200.
+func (pconn *persistentConn) readTransferResponse(noops int) (int, string, error) {
+	var (
+		code int
+		msg  string
+		got  bool
+	)
+
+	for i := 0; i <= noops; i++ {
+		replyCode, replyMsg, err := pconn.readResponse()
+		if err != nil {
+			return 0, "", err
+		}
+
+		if !got && (replyCode != replyCommandOkay || i == noops) {
+			code, msg, got = replyCode, replyMsg, true
+		}
+	}
+
+	return code, msg, nil
+}
+
+// Read a (possibly multi-line) response like textproto.Reader.ReadResponse,
+// but give up once the response exceeds MaxResponseLines or MaxResponseSize.
+func (pconn *persistentConn) readCodeLines() (int, string, error) {
+	line, err := pconn.reader.ReadLine()
+	if err != nil {
+		return 0, "", err
+	}
+
+	numLines, size := 1, len(line)
+	if err := pconn.checkResponseLimits(numLines, size); err != nil {
+		return 0, "", err
+	}
+
+	code, continued, msg, err := parseCodeLine(line)
+	if err != nil {
+		return 0, "", err
+	}
+
+	for continued {
+		line, err = pconn.reader.ReadLine()
+		if err != nil {
+			return 0, "", err
+		}
+
+		numLines++
+		size += len(line)
+		if err := pconn.checkResponseLimits(numLines, size); err != nil {
+			return 0, "", err
+		}
+
+		// lines that don't start with the response code are just more text
+		lineCode, lineContinued, more, err := parseCodeLine(line)
+		if err != nil || lineCode != code {
+			msg += "\n" + line
+			continue
+		}
+
+		continued = lineContinued
+		msg += "\n" + more
+	}
+
+	return code, msg, nil
+}
+
+func (pconn *persistentConn) checkResponseLimits(numLines, size int) error {
+	if max := pconn.config.MaxResponseLines; max > 0 && numLines > max {
+		return fmt.Errorf("response exceeded %d lines", max)
+	}
+
+	if max := pconn.config.MaxResponseSize; max > 0 && size > max {
+		return fmt.Errorf("response exceeded %d bytes", max)
+	}
+
+	return nil
+}
+
+// Parse a response line of the form "123 text" (or "123-text" if more lines
+// follow).
+func parseCodeLine(line string) (code int, continued bool, msg string, err error) {
+	if len(line) < 4 || (line[3] != ' ' && line[3] != '-') {
+		return 0, false, "", fmt.Errorf("short response: %s", line)
+	}
+
+	code, err = strconv.Atoi(line[0:3])
+	if err != nil || code < 100 {
+		return 0, false, "", fmt.Errorf("invalid response code: %s", line)
+	}
+
+	return code, line[3] == '-', line[4:], nil
+}
+
+// Decode text received from the server using PathEncoding, if configured.
+// Text that can't be decoded is returned as is.
+func (pconn *persistentConn) decode(s string) string {
+	if pconn.config.PathEncoding == nil {
+		return s
+	}
+
+	decoded, err := pconn.config.PathEncoding.Decode(s)
+	if err != nil {
+		pconn.debug("error decoding %q: %s", s, err)
+		return s
+	}
+
+	return decoded
 }
 
 func (pconn *persistentConn) debug(f string, args ...interface{}) {
+	if pconn.config.Slog != nil {
+		pconn.config.Slog.Debug(fmt.Sprintf(f, args...), "conn", pconn.idx)
+	}
+
+	pconn.debugText(f, args...)
+}
+
+// Like debug, but only logs to Config.Logger (used where a structured
+// message is logged separately).
+func (pconn *persistentConn) debugText(f string, args ...interface{}) {
 	if pconn.config.Logger == nil {
 		return
 	}
@@ -204,18 +695,38 @@ func (pconn *persistentConn) fetchFeatures() error {
 		return nil
 	}
 
+	pconn.features = parseFeatures(msg)
+
+	return nil
+}
+
+// Parse a FEAT response into a map of upper-cased feature name to feature
+// parameters (if any).
+func parseFeatures(msg string) map[string]string {
+	features := make(map[string]string)
+
 	for _, line := range strings.Split(msg, "\n") {
-		if len(line) > 0 && line[0] == ' ' {
-			parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
-			if len(parts) == 1 {
-				pconn.features[strings.ToUpper(parts[0])] = ""
-			} else if len(parts) == 2 {
-				pconn.features[strings.ToUpper(parts[0])] = parts[1]
-			}
+		line = strings.TrimRight(line, "\r")
+
+		// feature lines start with a space, other lines are status text
+		if len(line) == 0 || line[0] != ' ' {
+			continue
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 1 {
+			features[strings.ToUpper(parts[0])] = ""
+		} else {
+			features[strings.ToUpper(parts[0])] = strings.TrimSpace(parts[1])
 		}
 	}
 
-	return nil
+	return features
 }
 
 func (pconn *persistentConn) hasFeature(name string) bool {
@@ -228,6 +739,26 @@ func (pconn *persistentConn) hasFeatureWithArg(name, arg string) bool {
 	return found && strings.ToUpper(arg) == val
 }
 
+// Select the virtual host with "HOST". This happens before logging in (and
+// before "AUTH TLS"), so we can't check FEAT for support first.
+func (pconn *persistentConn) sendHost() error {
+	code, msg, err := pconn.sendCommand("HOST %s", pconn.config.Host)
+	if err != nil {
+		return err
+	}
+
+	if code == replyCommandSyntaxError || code == replyCommandNotImplemented {
+		pconn.debug("server doesn't support HOST: %d-%s", code, msg)
+		return nil
+	}
+
+	if !positiveCompletionReply(code) {
+		return ftpError{code: code, msg: msg}
+	}
+
+	return nil
+}
+
 func (pconn *persistentConn) logIn() error {
 	if pconn.config.User == "" {
 		return nil
@@ -246,21 +777,19 @@ func (pconn *persistentConn) logIn() error {
 		}
 	}
 
+	if code == replyNeedAccount && pconn.config.Account != "" {
+		code, msg, err = pconn.sendCommand("ACCT %s", pconn.config.Account)
+		if err != nil {
+			return err
+		}
+	}
+
 	if !positiveCompletionReply(code) {
 		return ftpError{code: code, msg: msg}
 	}
 
 	if pconn.config.TLSConfig != nil && pconn.config.TLSMode == TLSImplicit {
-
-		err = pconn.sendCommandExpected(replyGroupPositiveCompletion, "PBSZ 0")
-		if err != nil {
-			return err
-		}
-
-		err = pconn.sendCommandExpected(replyGroupPositiveCompletion, "PROT P")
-		if err != nil {
-			return err
-		}
+		return pconn.setDataProtection()
 	}
 
 	return nil
@@ -301,12 +830,14 @@ func (pconn *persistentConn) requestPassive() (string, error) {
 	endIdx = strings.LastIndex(msg, "|")
 	if startIdx == -1 || endIdx == -1 || startIdx+3 > endIdx {
 		pconn.debug("failed parsing EPSV response: %s", msg)
+		pconn.epsvNotSupported = true
 		goto PASV
 	}
 
 	port, err = strconv.Atoi(msg[startIdx+3 : endIdx])
 	if err != nil {
 		pconn.debug("EPSV response didn't contain port: %s", msg)
+		pconn.epsvNotSupported = true
 		goto PASV
 	}
 
@@ -316,7 +847,7 @@ func (pconn *persistentConn) requestPassive() (string, error) {
 		goto PASV
 	}
 
-	return fmt.Sprintf("[%s]:%d", remoteHost, port), nil
+	return pconn.rewritePassiveAddr(fmt.Sprintf("[%s]:%d", remoteHost, port)), nil
 
 PASV:
 	code, msg, err = pconn.sendCommand("PASV")
@@ -358,9 +889,51 @@ PASV:
 		port |= portOctet << (byte(1-i) * 8)
 	}
 
+	if pconn.config.RewritePassiveAddr != nil {
+		return pconn.rewritePassiveAddr(net.JoinHostPort(ip.String(), strconv.Itoa(port))), nil
+	}
+
+	if pconn.config.IgnorePASVAddress {
+		remoteHost, _, err = net.SplitHostPort(pconn.controlConn.RemoteAddr().String())
+		if err != nil {
+			return "", ftpError{err: fmt.Errorf("failed determining remote host: %s", err)}
+		}
+
+		pconn.debug("ignoring PASV address %s, using %s", ip, remoteHost)
+
+		return net.JoinHostPort(remoteHost, strconv.Itoa(port)), nil
+	}
+
 	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
 }
 
+// Apply Config.RewritePassiveAddr, if set, to the address from an EPSV or
+// PASV reply.
+func (pconn *persistentConn) rewritePassiveAddr(reported string) string {
+	if pconn.config.RewritePassiveAddr == nil {
+		return reported
+	}
+
+	addr := pconn.config.RewritePassiveAddr(reported, pconn.controlConn.RemoteAddr().String())
+	if addr != reported {
+		pconn.debug("rewrote passive address %s to %s", reported, addr)
+	}
+
+	return addr
+}
+
+// Whether the control connection is over IPv6, in which case PASV can't be
+// used.
+func (pconn *persistentConn) controlConnIPv6() bool {
+	host, _, err := net.SplitHostPort(pconn.controlConn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
 type dataConn struct {
 	net.Conn
 	Timeout time.Duration
@@ -377,70 +950,323 @@ func (c *dataConn) Write(buf []byte) (int, error) {
 }
 
 func (pconn *persistentConn) prepareDataConn() (func() (net.Conn, error), error) {
-	if pconn.config.ActiveTransfers {
-		listener, err := pconn.listenActive()
-		if err != nil {
-			return nil, err
+	switch pconn.config.TransferMode {
+	case ActiveOnly:
+		return pconn.prepareActiveDataConn()
+	case PassivePreferred, ActivePreferred:
+		prepare, fallback := pconn.preparePassiveDataConn, pconn.prepareActiveDataConn
+		if (pconn.config.TransferMode == ActivePreferred) != pconn.dataModeFallback {
+			prepare, fallback = fallback, prepare
 		}
 
-		return func() (net.Conn, error) {
-			defer func() {
-				if err := listener.Close(); err != nil {
-					pconn.debug("error closing data connection listener: %s", err)
-				}
-			}()
+		getter, err := prepare()
+		if err == nil || pconn.broken {
+			return getter, err
+		}
 
-			listener.SetDeadline(time.Now().Add(pconn.config.Timeout))
-			dc, netErr := listener.Accept()
+		pconn.debug("error preparing data connection, falling back: %s", err)
 
-			if netErr != nil {
-				var isTemporary bool
-				if ne, ok := netErr.(net.Error); ok {
-					isTemporary = ne.Temporary()
-				}
-				return nil, ftpError{err: netErr, temporary: isTemporary}
-			}
+		getter, err = fallback()
+		if err == nil {
+			// stick with what works for this connection
+			pconn.dataModeFallback = !pconn.dataModeFallback
+		}
+		return getter, err
+	default:
+		return pconn.preparePassiveDataConn()
+	}
+}
 
-			if pconn.config.TLSConfig != nil {
-				dc = tls.Server(dc, pconn.config.TLSConfig)
-				pconn.debug("upgraded active connection to TLS")
-			}
+func (pconn *persistentConn) prepareActiveDataConn() (func() (net.Conn, error), error) {
+	// in case a previous getter was never called
+	pconn.closeActiveListener()
+
+	listener, err := pconn.listenActive()
+	if err != nil {
+		return nil, err
+	}
+
+	pconn.connMu.Lock()
+	pconn.activeListener = listener
+	pconn.connMu.Unlock()
+
+	return func() (net.Conn, error) {
+		defer pconn.closeActiveListener()
+
+		listener.SetDeadline(time.Now().Add(pconn.config.DataTimeout))
+		dc, netErr := listener.Accept()
+
+		if netErr != nil {
+			return nil, DataConnError{Addr: listener.Addr().String(), Active: true, Err: netErr}
+		}
 
-			pconn.dataConn = &dataConn{
-				Conn:    dc,
-				Timeout: pconn.config.Timeout,
+		if err := runConnCallback(pconn.config.DataConnCallback, dc); err != nil {
+			// the server will report the transfer failing at some point
+			pconn.broken = true
+			return nil, err
+		}
+
+		if tlsConfig := pconn.dataTLSConfig(); tlsConfig != nil {
+			tlsConn := tls.Server(dc, tlsConfig)
+			if err := tlsHandshake(tlsConn, pconn.config.DataTimeout); err != nil {
+				dc.Close()
+				pconn.broken = true
+				return nil, err
 			}
-			return pconn.dataConn, nil
-		}, nil
-	} else {
-		host, err := pconn.requestPassive()
+			dc = tlsConn
+			pconn.debug("upgraded active connection to TLS")
+		}
+
+		return pconn.setDataConn(dc), nil
+	}, nil
+}
+
+func (pconn *persistentConn) preparePassiveDataConn() (func() (net.Conn, error), error) {
+	host, err := pconn.requestPassive()
+	if err != nil {
+		return nil, err
+	}
+
+	dc, netErr := pconn.dialPassive(host)
+
+	// EPSV can succeed but hand out an unreachable port (e.g. behind a
+	// misconfigured NAT), so try PASV, and only stop using EPSV if PASV
+	// works. PASV can't work over IPv6.
+	retriedPASV := netErr != nil && !pconn.epsvNotSupported && !pconn.controlConnIPv6()
+	if retriedPASV {
+		pconn.debug("error connecting to EPSV port, trying PASV: %s", netErr)
+		pconn.epsvNotSupported = true
+
+		host, err = pconn.requestPassive()
 		if err != nil {
+			pconn.epsvNotSupported = false
 			return nil, err
 		}
 
-		pconn.debug("opening data connection to %s", host)
-		dc, netErr := net.DialTimeout("tcp", host, pconn.config.Timeout)
+		dc, netErr = pconn.dialPassive(host)
+	}
 
-		if netErr != nil {
-			var isTemporary bool
-			if ne, ok := netErr.(net.Error); ok {
-				isTemporary = ne.Temporary()
-			}
-			return nil, ftpError{err: netErr, temporary: isTemporary}
+	if netErr != nil {
+		if retriedPASV {
+			// PASV didn't help either, so don't give up on EPSV
+			pconn.epsvNotSupported = false
 		}
+		return nil, DataConnError{Addr: host, Err: netErr}
+	}
 
-		if pconn.config.TLSConfig != nil {
+	if err := runConnCallback(pconn.config.DataConnCallback, dc); err != nil {
+		return nil, err
+	}
+
+	return func() (net.Conn, error) {
+		// the server may not start TLS until it has received the transfer
+		// command, so wait until now to handshake
+		if tlsConfig := pconn.dataTLSConfig(); tlsConfig != nil {
 			pconn.debug("upgrading data connection to TLS")
-			dc = tls.Client(dc, pconn.config.TLSConfig)
+			tlsConn := tls.Client(dc, tlsConfig)
+			if err := tlsHandshake(tlsConn, pconn.config.DataTimeout); err != nil {
+				dc.Close()
+				pconn.broken = true
+				return nil, err
+			}
+			dc = tlsConn
 		}
 
-		return func() (net.Conn, error) {
-			pconn.dataConn = &dataConn{
-				Conn:    dc,
-				Timeout: pconn.config.Timeout,
-			}
-			return pconn.dataConn, nil
-		}, nil
+		return pconn.setDataConn(dc), nil
+	}, nil
+}
+
+// Open the data connection to host, from an EPSV or PASV reply. The address
+// in a PASV reply may be unreachable (e.g. a private address behind NAT), so
+// if connecting to it fails the control connection's host is tried instead,
+// and used for the connection's later PASV replies until it fails too.
+func (pconn *persistentConn) dialPassive(host string) (net.Conn, error) {
+	var controlAddr string
+	if pconn.epsvNotSupported && !pconn.config.IgnorePASVAddress && pconn.config.RewritePassiveAddr == nil {
+		controlHost, _, err := net.SplitHostPort(pconn.controlConn.RemoteAddr().String())
+		pasvHost, port, _ := net.SplitHostPort(host)
+		if err == nil && controlHost != pasvHost {
+			controlAddr = net.JoinHostPort(controlHost, port)
+		}
+	}
+
+	if controlAddr != "" && pconn.pasvAddressUnusable {
+		pconn.debug("ignoring PASV address %s, opening data connection to %s", host, controlAddr)
+		dc, err := pconn.dial(controlAddr, pconn.config.DataTimeout)
+		if err == nil {
+			return dc, nil
+		}
+
+		// maybe the PASV address works now; try it once
+		pconn.debug("error connecting to %s, trying PASV address: %s", controlAddr, err)
+		pconn.pasvAddressUnusable = false
+
+		pconn.debug("opening data connection to %s", host)
+		return pconn.dial(host, pconn.config.DataTimeout)
+	}
+
+	pconn.debug("opening data connection to %s", host)
+	dc, err := pconn.dial(host, pconn.config.DataTimeout)
+	if err == nil || controlAddr == "" {
+		return dc, err
+	}
+
+	pconn.debug("error connecting to PASV address, trying %s: %s", controlAddr, err)
+	dc, controlErr := pconn.dial(controlAddr, pconn.config.DataTimeout)
+	if controlErr != nil {
+		return nil, err
+	}
+
+	pconn.pasvAddressUnusable = true
+
+	return dc, nil
+}
+
+// Dial a new control connection, running Config.ControlConnCallback on it.
+func (pconn *persistentConn) dialControl(host string) (net.Conn, error) {
+	conn, err := pconn.dial(host, pconn.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runConnCallback(pconn.config.ControlConnCallback, conn); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Run Config.ControlConnCallback or Config.DataConnCallback (if set) on a
+// new connection, closing the connection if the callback fails.
+func runConnCallback(cb func(net.Conn) error, conn net.Conn) error {
+	if cb == nil {
+		return nil
+	}
+
+	if err := cb(conn); err != nil {
+		conn.Close()
+		return ftpError{err: fmt.Errorf("connection callback failed: %s", err)}
+	}
+
+	return nil
+}
+
+// Open a TCP connection to addr using Config.Proxy or Config.DialContext, if
+// set. Otherwise the connection's source address is Config.LocalAddr, if set.
+// The dial is abandoned if the current operation's context is done.
+func (pconn *persistentConn) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if pconn.config.Proxy != nil {
+		return pconn.config.Proxy("tcp", addr)
+	}
+
+	ctx := pconn.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if pconn.config.DialContext == nil {
+		dialer := &net.Dialer{
+			Timeout:   timeout,
+			LocalAddr: pconn.config.LocalAddr,
+		}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return pconn.config.DialContext(ctx, "tcp", addr)
+}
+
+// Perform the TLS handshake on conn up front so failures (e.g. certificate
+// verification errors) are reported as such, rather than surfacing from the
+// first read or write.
+func tlsHandshake(conn *tls.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+
+	if err != nil {
+		return tlsHandshakeError(err)
+	}
+
+	return nil
+}
+
+// Describe a TLS handshake failure, including the server certificate's
+// subject and names if the certificate failed verification.
+func tlsHandshakeError(err error) error {
+	var (
+		cert         *x509.Certificate
+		hostnameErr  x509.HostnameError
+		authorityErr x509.UnknownAuthorityError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	// newer versions of crypto/tls wrap verification errors
+	switch {
+	case errors.As(err, &hostnameErr):
+		cert = hostnameErr.Certificate
+	case errors.As(err, &authorityErr):
+		cert = authorityErr.Cert
+	case errors.As(err, &invalidErr):
+		cert = invalidErr.Cert
+	}
+
+	msg := "TLS handshake failed"
+	if cert != nil {
+		names := append(append([]string{}, cert.DNSNames...), ipStrings(cert.IPAddresses)...)
+		msg = fmt.Sprintf("TLS certificate verification failed (certificate subject %q, SANs %v)", cert.Subject.String(), names)
+	}
+
+	// keep err available to errors.As
+	return ftpError{err: fmt.Errorf("%s: %w", msg, err)}
+}
+
+func ipStrings(ips []net.IP) []string {
+	var ret []string
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
+
+// TLS config for data connections, or nil if they shouldn't use TLS.
+func (pconn *persistentConn) dataTLSConfig() *tls.Config {
+	if pconn.config.TLSConfig == nil || pconn.config.ClearDataChannel {
+		return nil
+	}
+
+	if pconn.config.DataTLSConfig != nil {
+		return pconn.config.DataTLSConfig
+	}
+
+	return pconn.config.TLSConfig
+}
+
+// Give the connection's control and data TLS configs a shared session
+// cache, and the same ServerName (the cache key), so data connections resume
+// the control connection's TLS session. The configs are cloned so the
+// Client's configs aren't modified.
+func (pconn *persistentConn) enableTLSSessionReuse() {
+	cache := tls.NewLRUClientSessionCache(1)
+
+	controlConfig := pconn.config.TLSConfig.Clone()
+	controlConfig.ClientSessionCache = cache
+	if controlConfig.ServerName == "" {
+		controlConfig.ServerName, _, _ = net.SplitHostPort(pconn.host)
+	}
+
+	pconn.config.TLSConfig = controlConfig
+
+	// data connections may not use TLS at all (see ClearDataChannel)
+	if dataConfig := pconn.dataTLSConfig(); dataConfig != nil {
+		dataConfig = dataConfig.Clone()
+		dataConfig.ClientSessionCache = cache
+		if dataConfig.ServerName == "" {
+			dataConfig.ServerName = controlConfig.ServerName
+		}
+		pconn.config.DataTLSConfig = dataConfig
 	}
 }
 
@@ -461,17 +1287,33 @@ func (pconn *persistentConn) listenActive() (*net.TCPListener, error) {
 		listenAddr = net.JoinHostPort(localHost, listenAddr[1:])
 	}
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
-	if err != nil {
-		return nil, ftpError{err: fmt.Errorf("error parsing active listen addr: %s (%s)", err, listenAddr)}
-	}
+	var listener *net.TCPListener
+	if pconn.config.ActivePortRange != [2]int{} {
+		listener, err = pconn.listenPortRange(listenAddr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
+		if err != nil {
+			return nil, ftpError{err: fmt.Errorf("error parsing active listen addr: %s (%s)", err, listenAddr)}
+		}
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		return nil, ftpError{err: fmt.Errorf("error listening on %s for active transfer: %s", listenAddr, err)}
+		listener, err = net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			return nil, ftpError{err: fmt.Errorf("error listening on %s for active transfer: %s", listenAddr, err)}
+		}
 	}
 	pconn.debug("listening on %s for active connection", listener.Addr().String())
 
+	// don't leak the listener if we can't tell the server about it
+	success := false
+	defer func() {
+		if !success {
+			listener.Close()
+		}
+	}()
+
 	listenHost, listenPortStr, err := net.SplitHostPort(listener.Addr().String())
 	if err != nil {
 		return nil, ftpError{err: fmt.Errorf("error splitting listener addr: %s (%s)", err, listener.Addr().String())}
@@ -487,13 +1329,14 @@ func (pconn *persistentConn) listenActive() (*net.TCPListener, error) {
 		return nil, ftpError{err: fmt.Errorf("failed parsing host IP %s", listenHost)}
 	}
 
+	// PORT can only express IPv4 addresses, so use EPRT (RFC 2428) for IPv6
 	hostIPv4 := hostIP.To4()
 	if hostIPv4 == nil {
-		if err := pconn.sendCommandExpected(200, "EPRT |%d|%s|%d|", 2, listenHost, listenPort); err != nil {
+		if err := pconn.sendCommandExpected(replyCommandOkay, "EPRT |%d|%s|%d|", 2, listenHost, listenPort); err != nil {
 			return nil, err
 		}
 	} else {
-		err := pconn.sendCommandExpected(200, "PORT %d,%d,%d,%d,%d,%d",
+		err := pconn.sendCommandExpected(replyCommandOkay, "PORT %d,%d,%d,%d,%d,%d",
 			hostIPv4[0], hostIPv4[1], hostIPv4[2], hostIPv4[3],
 			listenPort>>8, listenPort&0xFF,
 		)
@@ -502,16 +1345,67 @@ func (pconn *persistentConn) listenActive() (*net.TCPListener, error) {
 		}
 	}
 
+	success = true
+
 	return listener, nil
 }
 
+// Listen on the host of listenAddr using the first free port in
+// ActivePortRange. The search starts at a random port in the range so
+// concurrent connections don't all contend for the same low ports.
+func (pconn *persistentConn) listenPortRange(listenAddr string) (*net.TCPListener, error) {
+	low, high := pconn.config.ActivePortRange[0], pconn.config.ActivePortRange[1]
+	if low <= 0 || high > 65535 || low > high {
+		return nil, ftpError{err: fmt.Errorf("invalid active port range %d-%d", low, high)}
+	}
+
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, ftpError{err: fmt.Errorf("error splitting active listen addr: %s (%s)", err, listenAddr)}
+	}
+
+	numPorts := high - low + 1
+	start := rand.Intn(numPorts)
+	for i := 0; i < numPorts; i++ {
+		addr := net.JoinHostPort(host, strconv.Itoa(low+(start+i)%numPorts))
+
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, ftpError{err: fmt.Errorf("error parsing active listen addr: %s (%s)", err, addr)}
+		}
+
+		listener, err := net.ListenTCP("tcp", tcpAddr)
+		if err == nil {
+			return listener, nil
+		}
+
+		if !isAddrInUse(err) {
+			return nil, ftpError{err: fmt.Errorf("error listening on %s for active transfer: %s", addr, err)}
+		}
+	}
+
+	return nil, ftpError{
+		err:       fmt.Errorf("all ports in active port range %d-%d are in use", low, high),
+		temporary: true,
+	}
+}
+
+func isAddrInUse(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.EADDRINUSE
+		}
+	}
+	return false
+}
+
 func (pconn *persistentConn) setType(t string) error {
 	if pconn.currentType == t {
 		pconn.debug("type already set to %s", t)
 		return nil
 	}
 	err := pconn.sendCommandExpected(replyCommandOkay, "TYPE %s", t)
-	if err != nil {
+	if err == nil {
 		pconn.currentType = t
 	}
 	return err
@@ -523,19 +1417,21 @@ func (pconn *persistentConn) logInTLS() error {
 		return err
 	}
 
-	pconn.setControlConn(tls.Client(pconn.controlConn, pconn.config.TLSConfig))
+	tlsConn := tls.Client(pconn.controlConn, pconn.config.TLSConfig)
+	pconn.setControlConn(tlsConn)
 
-	err = pconn.logIn()
+	err = tlsHandshake(tlsConn, pconn.config.Timeout)
 	if err != nil {
+		pconn.broken = true
 		return err
 	}
 
-	err = pconn.sendCommandExpected(replyGroupPositiveCompletion, "PBSZ 0")
+	err = pconn.logIn()
 	if err != nil {
 		return err
 	}
 
-	err = pconn.sendCommandExpected(replyGroupPositiveCompletion, "PROT P")
+	err = pconn.setDataProtection()
 	if err != nil {
 		return err
 	}
@@ -544,3 +1440,19 @@ func (pconn *persistentConn) logInTLS() error {
 
 	return nil
 }
+
+// Tell the server whether data connections will use TLS ("PROT P") or not
+// ("PROT C").
+func (pconn *persistentConn) setDataProtection() error {
+	err := pconn.sendCommandExpected(replyGroupPositiveCompletion, "PBSZ 0")
+	if err != nil {
+		return err
+	}
+
+	level := "P"
+	if pconn.config.ClearDataChannel {
+		level = "C"
+	}
+
+	return pconn.sendCommandExpected(replyGroupPositiveCompletion, "PROT %s", level)
+}
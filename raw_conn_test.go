@@ -5,9 +5,15 @@
 package goftp
 
 import (
+	"bufio"
 	"io/ioutil"
+	"net"
+	"net/textproto"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRawConn(t *testing.T) {
@@ -75,3 +81,245 @@ func TestRawConn(t *testing.T) {
 		}
 	}
 }
+
+func TestRawConnChangeDir(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.ChangeDir("subdir"); err != nil {
+			t.Fatal(err)
+		}
+
+		rawConn, err := c.OpenRawConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		code, msg, err := rawConn.SendCommand("PWD")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != 257 || !strings.Contains(msg, "subdir") {
+			t.Errorf("got %d %s", code, msg)
+		}
+
+		if err := rawConn.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRawConnAbort(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rawConn, err := c.OpenRawConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// nothing in progress, but server should still ack the ABOR
+		if err := rawConn.Abort(); err != nil {
+			t.Fatal(err)
+		}
+
+		// make sure we are still in sync
+		code, _, err := rawConn.SendCommand("PWD")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != 257 {
+			t.Errorf("got %d", code)
+		}
+
+		if err := rawConn.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestReadCodeLines(t *testing.T) {
+	newPconn := func(resp string, config Config) *persistentConn {
+		return &persistentConn{
+			config: config,
+			reader: textproto.NewReader(bufio.NewReader(strings.NewReader(resp))),
+		}
+	}
+
+	multi := "211-Features:\r\n MDTM\r\n211 End\r\n"
+
+	code, msg, err := newPconn(multi, Config{}).readCodeLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != 211 || msg != "Features:\n MDTM\nEnd" {
+		t.Errorf("Got %d %q", code, msg)
+	}
+
+	// malformed continuation line that never terminates
+	_, _, err = newPconn("211-Features:\r\n211-MDTM\r\n211-SIZE\r\n211-MLST\r\n", Config{MaxResponseLines: 3}).readCodeLines()
+	if err == nil || !strings.Contains(err.Error(), "3 lines") {
+		t.Errorf("Got %v", err)
+	}
+
+	_, _, err = newPconn(multi, Config{MaxResponseSize: 10}).readCodeLines()
+	if err == nil || !strings.Contains(err.Error(), "10 bytes") {
+		t.Errorf("Got %v", err)
+	}
+
+	_, _, err = newPconn("hello\r\n", Config{}).readCodeLines()
+	if err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func TestReadTransferResponse(t *testing.T) {
+	for _, replies := range []string{
+		"200 NOOP ok\r\n226 Transfer complete\r\n200 NOOP ok\r\n",
+		"226 Transfer complete\r\n200 NOOP ok\r\n200 NOOP ok\r\n",
+		"200 NOOP ok\r\n200 NOOP ok\r\n226 Transfer complete\r\n",
+	} {
+		client, server := net.Pipe()
+
+		go func() {
+			server.Write([]byte(replies + "200 next\r\n"))
+		}()
+
+		pconn := &persistentConn{config: Config{Timeout: time.Second}}
+		pconn.setControlConn(client)
+
+		code, msg, err := pconn.readTransferResponse(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != 226 || msg != "Transfer complete" {
+			t.Errorf("Got %d %s", code, msg)
+		}
+
+		// all the NOOP replies should have been consumed
+		_, msg, err = pconn.readResponse()
+		if err != nil || msg != "next" {
+			t.Errorf("Got %s %v", msg, err)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestLogInAccount(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var sent []string
+	go func() {
+		reader := textproto.NewReader(bufio.NewReader(server))
+		for _, reply := range []string{
+			"331 Need password\r\n",
+			"332 Need account\r\n",
+			"230 Logged in\r\n",
+		} {
+			line, err := reader.ReadLine()
+			if err != nil {
+				return
+			}
+			sent = append(sent, line)
+			server.Write([]byte(reply))
+		}
+	}()
+
+	pconn := &persistentConn{
+		config: Config{
+			User:     "goftp",
+			Password: "rocks",
+			Account:  "acme",
+			Timeout:  time.Second,
+		},
+		stats: new(clientStats),
+	}
+	pconn.setControlConn(client)
+
+	if err := pconn.logIn(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"USER goftp", "PASS rocks", "ACCT acme"}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Got %v", sent)
+	}
+}
+
+func TestAbortFinishedTransfer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sent := make(chan string, 10)
+	go func() {
+		reader := textproto.NewReader(bufio.NewReader(server))
+		for _, reply := range []string{
+			"150 Opening data connection\r\n",
+			// the transfer already finished, so its reply is still pending
+			"226 Transfer complete\r\n226 ABOR successful\r\n",
+			`257 "/" is the current directory` + "\r\n",
+		} {
+			line, err := reader.ReadLine()
+			if err != nil {
+				return
+			}
+			sent <- line
+			server.Write([]byte(reply))
+		}
+	}()
+
+	var hooked []string
+
+	pconn := &persistentConn{
+		config: Config{
+			Timeout: time.Second,
+			CommandHook: func(command string, code int, msg string) {
+				hooked = append(hooked, command)
+			},
+		},
+		stats: new(clientStats),
+	}
+	pconn.setControlConn(client)
+
+	if code, _, err := pconn.SendCommand("RETR foo"); err != nil || code != 150 {
+		t.Fatalf("Got %d, %v", code, err)
+	}
+
+	if err := pconn.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure we are still in sync
+	if code, _, err := pconn.SendCommand("PWD"); err != nil || code != 257 {
+		t.Errorf("Got %d, %v", code, err)
+	}
+
+	if line := <-sent + <-sent; line != "RETR foo"+telnetIPDM+"ABOR" {
+		t.Errorf("Got %q", line)
+	}
+
+	if !reflect.DeepEqual(hooked, []string{"RETR foo", "ABOR", "PWD"}) {
+		t.Errorf("Got %v", hooked)
+	}
+
+	if sent := atomic.LoadInt64(&pconn.stats.commandsSent); sent != 3 {
+		t.Errorf("Got %d", sent)
+	}
+}
@@ -54,6 +54,7 @@ const (
 	replyCommandNotImplemented             = 502
 	replyBadCommandSequence                = 503
 	replyCommandNotImplementedForParameter = 504
+	replyDirAlreadyExists                  = 521 // non-standard, but used by some servers
 	replyNotLoggedIn                       = 530
 	replyNeedAccountToStore                = 532
 	replyFileError                         = 550 // file not found, no access
@@ -0,0 +1,132 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Session runs a sequence of operations on a single connection borrowed
+// from a Client's pool (see Client.WithConn), so state such as the working
+// directory carries over from one operation to the next. A Session is only
+// valid until the function passed to WithConn returns, and is not safe for
+// concurrent use.
+type Session struct {
+	client *Client
+	pconn  *persistentConn
+
+	// directory to return to when the session ends, if ChangeDir was used
+	restoreDir string
+}
+
+// WithConn borrows one connection from the pool and passes fn a Session
+// bound to it, e.g. to change into a directory and upload several files
+// there. The connection is returned to the pool when fn returns, after
+// changing back to its original directory if necessary. WithConn returns
+// fn's error.
+func (c *Client) WithConn(fn func(s *Session) error) error {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return err
+	}
+
+	defer c.returnConn(pconn)
+
+	// the session's working directory would be lost by reconnecting
+	reconnect := pconn.reconnect
+	pconn.reconnect = nil
+	defer func() { pconn.reconnect = reconnect }()
+
+	s := &Session{client: c, pconn: pconn}
+
+	err = fn(s)
+
+	if s.restoreDir != "" {
+		if cwdErr := pconn.sendCommandExpected(replyFileActionOkay, "CWD %s", s.restoreDir); cwdErr != nil {
+			// don't reuse a connection in the wrong directory
+			pconn.debug("error restoring directory %s: %s", s.restoreDir, cwdErr)
+			pconn.broken = true
+		}
+	}
+
+	return err
+}
+
+// ChangeDir changes the session's working directory using "CWD". Unlike
+// Client.ChangeDir, this only affects the session's connection.
+func (s *Session) ChangeDir(path string) error {
+	if s.restoreDir == "" {
+		dir, err := s.pconn.getwd()
+		if err != nil {
+			return err
+		}
+		s.restoreDir = dir
+	}
+
+	return s.pconn.sendCommandExpected(replyFileActionOkay, "CWD %s", path)
+}
+
+// Getwd returns the session's current working directory.
+func (s *Session) Getwd() (string, error) {
+	return s.pconn.getwd()
+}
+
+// Retrieve is like Client.Retrieve, but doesn't resume failed transfers.
+func (s *Session) Retrieve(path string, dest io.Writer) error {
+	_, err := s.client.transferOnConn(context.Background(), s.pconn, s.client.config.DefaultTransferType, "RETR", path, dest, nil, 0, -1)
+	return err
+}
+
+// Store is like Client.Store, but doesn't resume failed transfers.
+func (s *Session) Store(path string, src io.Reader) error {
+	_, err := s.client.transferOnConn(context.Background(), s.pconn, s.client.config.DefaultTransferType, "STOR", path, nil, src, 0, -1)
+	return err
+}
+
+// List is like Client.List.
+func (s *Session) List(path string) ([]string, error) {
+	return s.lines("LIST %s", path)
+}
+
+// ReadDir is like Client.ReadDir.
+func (s *Session) ReadDir(path string) ([]os.FileInfo, error) {
+	return s.client.readDir(path, s.lines)
+}
+
+// Delete is like Client.Delete.
+func (s *Session) Delete(path string) error {
+	return s.pconn.sendCommandExpected(replyFileActionOkay, "DELE %s", path)
+}
+
+// Rename is like Client.Rename.
+func (s *Session) Rename(from, to string) error {
+	err := s.pconn.sendCommandExpected(replyFileActionPending, "RNFR %s", from)
+	if err != nil {
+		return err
+	}
+
+	return s.pconn.sendCommandExpected(replyFileActionOkay, "RNTO %s", to)
+}
+
+// Mkdir is like Client.Mkdir.
+func (s *Session) Mkdir(path string) (string, error) {
+	return s.pconn.mkdir(path)
+}
+
+// Rmdir is like Client.Rmdir.
+func (s *Session) Rmdir(path string) error {
+	return s.pconn.sendCommandExpected(replyFileActionOkay, "RMD %s", path)
+}
+
+func (s *Session) lines(f string, args ...interface{}) ([]string, error) {
+	var lines []string
+	err := s.client.dataLinesOnConn(context.Background(), s.pconn, func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}, f, args...)
+	return lines, err
+}
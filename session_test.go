@@ -0,0 +1,104 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWithConn(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("testroot/git-ignored/session")
+		if err := os.Mkdir("testroot/git-ignored/session", 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		origDir, err := c.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.WithConn(func(s *Session) error {
+			if err := s.ChangeDir("git-ignored/session"); err != nil {
+				return err
+			}
+
+			dir, err := s.Getwd()
+			if err != nil {
+				return err
+			}
+
+			if dir != path.Join(origDir, "git-ignored/session") {
+				t.Errorf("Got %s", dir)
+			}
+
+			for _, name := range []string{"a", "b"} {
+				if err := s.Store(name, bytes.NewReader([]byte{1, 2, 3, 4})); err != nil {
+					return err
+				}
+			}
+
+			entries, err := s.ReadDir("")
+			if err != nil {
+				return err
+			}
+
+			if len(entries) != 2 {
+				t.Errorf("Got %v", entries)
+			}
+
+			buf := new(bytes.Buffer)
+			if err := s.Retrieve("a", buf); err != nil {
+				return err
+			}
+
+			if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+				t.Errorf("Got %v", buf.Bytes())
+			}
+
+			return s.Delete("b")
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadFile("testroot/git-ignored/session/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, got) {
+			t.Errorf("Got %v", got)
+		}
+
+		if _, err := os.Stat("testroot/git-ignored/session/b"); !os.IsNotExist(err) {
+			t.Errorf("Expected b to be deleted, got %v", err)
+		}
+
+		// connection should be back in its original directory
+		dir, err := c.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dir != origDir {
+			t.Errorf("Expected %s, got %s", origDir, dir)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
@@ -5,10 +5,26 @@
 package goftp
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"net"
 	"os"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Retrieve file "path" from server and write bytes to "dest". If the
@@ -17,26 +33,112 @@ import (
 // Retrieve will also verify the file's size after the transfer if the
 // server supports the SIZE command.
 func (c *Client) Retrieve(path string, dest io.Writer) error {
+	return c.RetrieveContext(context.Background(), path, dest)
+}
+
+// RetrieveContext is like Retrieve, but the transfer is aborted if ctx is
+// done before it completes. Control connection deadlines are also capped at
+// ctx's deadline, if it has one.
+func (c *Client) RetrieveContext(ctx context.Context, path string, dest io.Writer) error {
+	_, err := c.retrieve(ctx, c.config.DefaultTransferType, path, dest, 0)
+	return err
+}
+
+// RetrieveASCII is like Retrieve, but transfers the file in ASCII mode
+// ("TYPE A") so the server translates line endings, regardless of
+// Config.DefaultTransferType. Since the number of bytes transferred in ASCII
+// mode needn't match the file's size, failed downloads are not resumed and
+// the file's size is not verified.
+func (c *Client) RetrieveASCII(path string, dest io.Writer) error {
+	_, err := c.retrieve(context.Background(), TransferASCII, path, dest, 0)
+	return err
+}
+
+// RetrieveFrom is like Retrieve, but starts the transfer at byte "offset"
+// of the remote file and only writes bytes beyond it to "dest". This is
+// useful for resuming a download into a partially written local file (pass
+// the local file's size as the offset). The server must support resuming
+// stream transfers if offset is non-zero. The file's size is verified after
+// the transfer, accounting for the offset, if the server supports the SIZE
+// command.
+func (c *Client) RetrieveFrom(path string, dest io.Writer, offset int64) error {
+	_, err := c.retrieve(context.Background(), c.config.DefaultTransferType, path, dest, offset)
+	return err
+}
+
+// RetrieveOffset is like RetrieveFrom, but also returns the number of bytes
+// written to "dest". If the server supports the SIZE command, an offset
+// past the end of the file returns an error, an offset equal to the file's
+// size returns 0 bytes and no error (without transferring anything), and
+// the transfer is verified such that offset plus bytes written equals the
+// file's size.
+func (c *Client) RetrieveOffset(path string, dest io.Writer, offset int64) (int64, error) {
+	return c.retrieve(context.Background(), c.config.DefaultTransferType, path, dest, offset)
+}
+
+// retrieve "path" starting at "offset", resuming failed transfers when
+// possible. Returns the number of bytes written to "dest".
+func (c *Client) retrieve(ctx context.Context, typ TransferType, path string, dest io.Writer, offset int64) (int64, error) {
+	if typ == TransferASCII {
+		if offset > 0 {
+			return 0, ftpError{err: fmt.Errorf("can't retrieve %s from offset %d in ASCII mode", path, offset)}
+		}
+
+		return c.transferFromOffset(ctx, typ, "RETR", path, dest, nil, 0, -1)
+	}
+
 	// fetch file size to check against how much we transferred
 	size, err := c.size(path)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	if size != -1 {
+		if offset > size {
+			return 0, ftpError{err: fmt.Errorf("offset %d is past end of %s (size %d)", offset, path, size)}
+		} else if offset > 0 && offset == size {
+			// nothing left to transfer
+			return 0, nil
+		}
+	}
+
+	var checksum *ChecksumWriter
+	if c.config.VerifyChecksum && offset == 0 {
+		algo, err := c.checksumAlgorithm()
+		if err != nil {
+			return 0, err
+		}
+
+		if algo != "" {
+			checksum, _ = NewChecksumWriter(dest, algo)
+			dest = checksum
+		}
 	}
 
 	canResume := c.canResume()
 
-	var bytesSoFar int64
-	for {
-		n, err := c.transferFromOffset(path, dest, nil, bytesSoFar)
+	if offset > 0 && !canResume {
+		return 0, ftpError{err: fmt.Errorf("can't retrieve %s from offset %d: server doesn't support resuming transfers", path, offset)}
+	}
+
+	bytesSoFar := offset
+	for attempt := 0; ; attempt++ {
+		n, err := c.transferFromOffset(ctx, typ, "RETR", path, dest, nil, bytesSoFar, size)
 
 		bytesSoFar += n
 
 		if err == nil {
 			break
+		} else if ctx.Err() != nil {
+			return bytesSoFar - offset, err
 		} else if n == 0 {
-			return err
+			// we can start over if nothing has been written to dest at all
+			if bytesSoFar == offset && c.shouldRetry(attempt, err) {
+				continue
+			}
+			return bytesSoFar - offset, err
 		} else if !canResume {
-			return ftpError{
+			return bytesSoFar - offset, ftpError{
 				err:       fmt.Errorf("%s (can't resume)", err),
 				temporary: true,
 			}
@@ -44,15 +146,411 @@ func (c *Client) Retrieve(path string, dest io.Writer) error {
 	}
 
 	if size != -1 && bytesSoFar != size {
-		return ftpError{
+		return bytesSoFar - offset, ftpError{
 			err:       fmt.Errorf("expected %d bytes, got %d", size, bytesSoFar),
 			temporary: true,
 		}
 	}
 
+	if checksum != nil {
+		remote, err := c.Hash(path, checksum.Algorithm())
+		if err != nil {
+			return bytesSoFar - offset, err
+		}
+
+		if local := checksum.Sum(); remote != local {
+			return bytesSoFar - offset, ftpError{
+				err: fmt.Errorf("%s checksum mismatch for %s: server has %s, got %s", checksum.Algorithm(), path, remote, local),
+			}
+		}
+	}
+
+	return bytesSoFar - offset, nil
+}
+
+// RetrieveParallel retrieves file "path" like Retrieve, but splits it into
+// "chunks" byte ranges that are downloaded concurrently on separate pooled
+// connections (using "REST" to start each at its offset) and written to
+// "dest" at the corresponding offsets. This can make much better use of high
+// latency links than a single stream. The number of chunks is capped at the
+// pool size (ConnectionsPerHost per host). If the server doesn't support SIZE
+// and resuming stream transfers, or there is only one chunk, the file is
+// retrieved with a single stream instead. Transfers of all but the last
+// chunk are cut short, so their connections are closed afterwards. Chunks
+// are resumed individually if they fail part way. Config.ProgressCallback,
+// if set, is called concurrently for each chunk.
+func (c *Client) RetrieveParallel(path string, dest io.WriterAt, chunks int) error {
+	if max := c.config.ConnectionsPerHost * len(c.hosts); chunks > max {
+		chunks = max
+	}
+
+	size := int64(-1)
+	if chunks > 1 && c.config.DefaultTransferType != TransferASCII {
+		var err error
+		if size, err = c.size(path); err != nil {
+			return err
+		}
+	}
+
+	if size < int64(chunks) || !c.canResume() {
+		c.debug("retrieving %s in a single stream", path)
+		return c.Retrieve(path, &offsetWriter{w: dest})
+	}
+
+	chunkSize := size / int64(chunks)
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, chunks)
+	)
+
+	for i := 0; i < chunks; i++ {
+		start, end := int64(i)*chunkSize, int64(i+1)*chunkSize
+		if i == chunks-1 {
+			end = size
+		}
+
+		wg.Add(1)
+		go func(i int, start, end int64) {
+			defer wg.Done()
+			errs[i] = c.retrieveChunk(path, dest, start, end, size)
+		}(i, start, end)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returned by offsetWriter once it has written everything up to its limit.
+var errChunkDone = errors.New("chunk complete")
+
+// Retrieve bytes [start, end) of "path" into dest, resuming the transfer
+// when it fails part way.
+func (c *Client) retrieveChunk(path string, dest io.WriterAt, start, end, size int64) error {
+	offset := start
+	for attempt := 0; ; attempt++ {
+		w := &offsetWriter{w: dest, offset: offset, limit: end}
+		n, err := c.transferFromOffset(context.Background(), c.config.DefaultTransferType, "RETR", path, w, nil, offset, size)
+
+		offset += n
+
+		if err == errChunkDone || err == nil && offset == end {
+			return nil
+		} else if err == nil {
+			return ftpError{
+				err:       fmt.Errorf("expected %d bytes at offset %d, got %d", end-start, start, offset-start),
+				temporary: true,
+			}
+		} else if n == 0 && !c.shouldRetry(attempt, err) {
+			return err
+		}
+
+		c.debug("resuming chunk of %s at %d: %s", path, offset, err)
+	}
+}
+
+// io.Writer writing sequentially to an io.WriterAt starting at offset. If
+// limit is non-zero, bytes beyond it are discarded and errChunkDone is
+// returned.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+	limit  int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	var done bool
+	if ow.limit > 0 && int64(len(p)) > ow.limit-ow.offset {
+		p = p[:ow.limit-ow.offset]
+		done = true
+	}
+
+	n, err := ow.w.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+
+	if err == nil && done {
+		err = errChunkDone
+	}
+
+	return n, err
+}
+
+// RetrieveToFile retrieves file "remotePath" from the server into local
+// file "localPath", creating or truncating it, and syncs it to disk. If the
+// transfer fails, the partially written local file is removed. To resume
+// into a partially written file instead, see RetrieveFrom.
+func (c *Client) RetrieveToFile(remotePath, localPath string) error {
+	f, err := os.Create(localPath)
+	if err != nil {
+		return ftpError{err: fmt.Errorf("error creating local file: %s", err)}
+	}
+
+	err = c.Retrieve(remotePath, f)
+
+	if err == nil {
+		if syncErr := f.Sync(); syncErr != nil {
+			err = ftpError{err: fmt.Errorf("error syncing local file: %s", syncErr)}
+		}
+	}
+
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = ftpError{err: fmt.Errorf("error closing local file: %s", closeErr)}
+	}
+
+	if err != nil {
+		os.Remove(localPath)
+		return err
+	}
+
 	return nil
 }
 
+// Open starts retrieving file "path" from the server and returns an
+// io.ReadCloser streaming its contents. Errors during the transfer are
+// returned from Read. Close must be called to read the server's final
+// response (returning any error it indicates) and release the connection
+// back to the pool. Unlike Retrieve, Open doesn't resume failed transfers or
+// verify the file's size.
+func (c *Client) Open(path string) (io.ReadCloser, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return nil, err
+	}
+
+	dc, err := pconn.openDataCommand(c.config.DefaultTransferType, "RETR", path, 0)
+	if err != nil {
+		c.returnConn(pconn)
+		return nil, err
+	}
+
+	return &transferConn{client: c, pconn: pconn, dc: dc, cmd: "RETR", path: path}, nil
+}
+
+// Create starts storing file "path" on the server and returns an
+// io.WriteCloser that streams bytes written to it to the file. Close must be
+// called to finish the upload, read the server's final response and release
+// the connection back to the pool; it also verifies the remote file's size
+// if the server supports the SIZE command. Unlike Store, failed uploads
+// can't be resumed in this streaming mode.
+func (c *Client) Create(path string) (io.WriteCloser, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return nil, err
+	}
+
+	dc, err := pconn.openDataCommand(c.config.DefaultTransferType, "STOR", path, 0)
+	if err != nil {
+		c.returnConn(pconn)
+		return nil, err
+	}
+
+	return &transferConn{client: c, pconn: pconn, dc: dc, cmd: "STOR", path: path}, nil
+}
+
+// Set the transfer type, set up a data connection and send "cmd path"
+// (preceded by "REST offset" if offset is non-zero), returning the data
+// connection.
+func (pconn *persistentConn) openDataCommand(typ TransferType, cmd, path string, offset int64) (net.Conn, error) {
+	if err := pconn.setType(string(typ)); err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		err := pconn.sendCommandExpected(replyFileActionPending, "REST %d", offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	connGetter, err := pconn.prepareDataConn()
+	if err != nil {
+		pconn.debug("error preparing data connection: %s", err)
+		return nil, err
+	}
+
+	err = pconn.sendCommandExpected(replyGroupPreliminaryReply, "%s %s", cmd, path)
+	if err != nil {
+		pconn.closeActiveListener()
+		return nil, err
+	}
+
+	dc, err := connGetter()
+	if err != nil {
+		pconn.debug("error getting data connection: %s", err)
+		return nil, err
+	}
+
+	return dc, nil
+}
+
+// A data connection for a transfer in progress. Closing it completes the
+// transfer and returns the control connection to the pool.
+type transferConn struct {
+	client *Client
+	pconn  *persistentConn
+	dc     net.Conn
+	cmd    string
+	path   string
+	n      int64
+	closed bool
+}
+
+func (tc *transferConn) Read(p []byte) (int, error) {
+	n, err := tc.dc.Read(p)
+	tc.n += int64(n)
+	if err != nil && err != io.EOF {
+		tc.pconn.broken = true
+	}
+	return n, err
+}
+
+func (tc *transferConn) Write(p []byte) (int, error) {
+	n, err := tc.dc.Write(p)
+	tc.n += int64(n)
+	if err != nil {
+		tc.pconn.broken = true
+	}
+	return n, err
+}
+
+func (tc *transferConn) Close() error {
+	if tc.closed {
+		return ftpError{err: errors.New("already closed")}
+	}
+	tc.closed = true
+
+	if err := tc.finish(); err != nil {
+		return err
+	}
+
+	// check the size of uploads (with the connection back in the pool)
+	if tc.cmd == "STOR" && tc.client.config.DefaultTransferType != TransferASCII {
+		size, err := tc.client.size(tc.path)
+		if err != nil {
+			return err
+		}
+		if size != -1 && size != tc.n {
+			return ftpError{
+				err:       fmt.Errorf("sent %d bytes, but size is %d", tc.n, size),
+				temporary: true,
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close the data connection and read the final response.
+func (tc *transferConn) finish() error {
+	defer tc.client.returnConn(tc.pconn)
+
+	atomic.AddInt64(&tc.client.stats.bytesTransferred, tc.n)
+
+	if err := tc.dc.Close(); err != nil {
+		tc.pconn.debug("error closing data connection: %s", err)
+	}
+
+	code, msg, err := tc.pconn.readResponse()
+	if err != nil {
+		tc.pconn.debug("error reading response after %s: %s", tc.cmd, err)
+		return err
+	}
+
+	if !positiveCompletionReply(code) {
+		tc.pconn.debug("unexpected response after %s: %d (%s)", tc.cmd, code, msg)
+		return ftpError{code: code, msg: msg}
+	}
+
+	return nil
+}
+
+// RetrieveAll retrieves the files in "paths" in parallel, writing each to
+// the same relative path under local directory "destDir" (creating
+// directories as needed). At most "concurrency" files are retrieved at once,
+// further limited by the size of the connection pool (concurrency <= 0 means
+// the pool size). A failed file doesn't stop the others from being
+// retrieved; if any fail, a RetrieveAllError is returned.
+func (c *Client) RetrieveAll(paths []string, destDir string, concurrency int) error {
+	maxConcurrency := len(c.hosts) * c.config.ConnectionsPerHost
+	if concurrency <= 0 || concurrency > maxConcurrency {
+		concurrency = maxConcurrency
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		errs     = make(map[string]error)
+		pathChan = make(chan string)
+	)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for remotePath := range pathChan {
+				// clean against root so ".." can't escape destDir
+				localPath := filepath.Join(destDir, filepath.FromSlash(pathpkg.Clean("/"+remotePath)))
+
+				err := os.MkdirAll(filepath.Dir(localPath), 0755)
+				if err != nil {
+					err = ftpError{err: fmt.Errorf("error creating local directory: %s", err)}
+				} else {
+					err = c.RetrieveToFile(remotePath, localPath)
+				}
+
+				if err != nil {
+					mu.Lock()
+					errs[remotePath] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, remotePath := range paths {
+		pathChan <- remotePath
+	}
+	close(pathChan)
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return RetrieveAllError{Errors: errs}
+	}
+
+	return nil
+}
+
+// RetrieveAllError is returned by RetrieveAll when some files couldn't be
+// retrieved.
+type RetrieveAllError struct {
+	// The error for each remote path that failed.
+	Errors map[string]error
+}
+
+func (e RetrieveAllError) Error() string {
+	paths := make([]string, 0, len(e.Errors))
+	for path := range e.Errors {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	msgs := make([]string, len(paths))
+	for i, path := range paths {
+		msgs[i] = fmt.Sprintf("%s: %s", path, e.Errors[path])
+	}
+
+	return fmt.Sprintf("failed retrieving %d file(s): %s", len(paths), strings.Join(msgs, "; "))
+}
+
 // Store bytes read from "src" into file "path" on the server. If the
 // server supports resuming stream transfers and "src" is an io.Seeker
 // (*os.File is an io.Seeker), Store will continue resuming a failed upload
@@ -61,20 +559,104 @@ func (c *Client) Retrieve(path string, dest io.Writer) error {
 // will also verify the remote file's size after the transfer if the server
 // supports the SIZE command.
 func (c *Client) Store(path string, src io.Reader) error {
+	return c.StoreContext(context.Background(), path, src)
+}
 
-	canResume := len(c.hosts) == 1 && c.canResume()
+// StoreContext is like Store, but the transfer is aborted if ctx is done
+// before it completes. Control connection deadlines are also capped at ctx's
+// deadline, if it has one.
+func (c *Client) StoreContext(ctx context.Context, path string, src io.Reader) error {
+	return c.store(ctx, c.config.DefaultTransferType, path, src)
+}
 
-	seeker, ok := src.(io.Seeker)
-	if !ok {
-		canResume = false
+// StoreASCII is like Store, but transfers the file in ASCII mode ("TYPE A")
+// so the server translates line endings, regardless of
+// Config.DefaultTransferType. Since the number of bytes transferred in ASCII
+// mode needn't match the file's size, failed uploads are not resumed and the
+// remote file's size is not verified.
+func (c *Client) StoreASCII(path string, src io.Reader) error {
+	return c.store(context.Background(), TransferASCII, path, src)
+}
+
+// StoreReader is like Store, but for sources that can't seek yet can be
+// regenerated from an offset, e.g. generated or compressed content. srcAt is
+// called with offset 0 to start the upload, and again with the number of
+// bytes the server has received if a failed upload is resumed (or with 0 if
+// it is retried from scratch), returning a reader positioned at that offset.
+// Readers that implement io.Closer are closed once they are no longer needed.
+func (c *Client) StoreReader(path string, srcAt func(offset int64) (io.Reader, error)) error {
+	var cur io.Reader
+
+	closeCur := func() {
+		if closer, ok := cur.(io.Closer); ok {
+			closer.Close()
+		}
+		cur = nil
 	}
 
+	defer closeCur()
+
+	at := func(offset int64) (io.Reader, error) {
+		closeCur()
+
+		r, err := srcAt(offset)
+		if err != nil {
+			return nil, err
+		}
+
+		cur = r
+		return r, nil
+	}
+
+	src, err := at(0)
+	if err != nil {
+		return ftpError{err: fmt.Errorf("error opening source: %s", err)}
+	}
+
+	return c.storeFrom(context.Background(), c.config.DefaultTransferType, path, src, at, -1)
+}
+
+func (c *Client) store(ctx context.Context, typ TransferType, path string, src io.Reader) error {
+	var (
+		srcAt func(offset int64) (io.Reader, error)
+		total = int64(-1)
+	)
+
+	if seeker, ok := src.(io.Seeker); ok {
+		srcAt = func(offset int64) (io.Reader, error) {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return src, nil
+		}
+
+		// total upload size for progress reporting, if we can tell (the
+		// upload starts at src's current position)
+		if c.config.ProgressCallback != nil {
+			total = seekerRemaining(seeker)
+		}
+	}
+
+	return c.storeFrom(ctx, typ, path, src, srcAt, total)
+}
+
+// Upload src to path, using srcAt (if not nil) to get a reader positioned
+// at a given offset in order to resume or restart a failed upload. total is
+// the upload size for progress reporting, or -1 if unknown.
+func (c *Client) storeFrom(ctx context.Context, typ TransferType, path string, src io.Reader, srcAt func(offset int64) (io.Reader, error), total int64) error {
+	if typ == TransferASCII {
+		_, err := c.transferFromOffset(ctx, typ, "STOR", path, nil, src, 0, -1)
+		return err
+	}
+
+	canResume := srcAt != nil && len(c.hosts) == 1 && c.canResume()
+
 	var (
 		bytesSoFar int64
 		err        error
 		n          int64
 	)
-	for {
+	for attempt := 0; ; attempt++ {
 		if bytesSoFar > 0 {
 			size, sizeErr := c.size(path)
 			if sizeErr != nil {
@@ -90,28 +672,38 @@ func (c *Client) Store(path string, src io.Reader) error {
 				}
 			}
 
-			_, seekErr := seeker.Seek(size, os.SEEK_SET)
-			if seekErr != nil {
-				c.debug("failed seeking to %d while resuming upload to %s: %s",
+			resumed, srcErr := srcAt(size)
+			if srcErr != nil {
+				c.debug("failed getting source at %d while resuming upload to %s: %s",
 					size,
 					path,
-					err,
+					srcErr,
 				)
 				return ftpError{
 					err:       fmt.Errorf("%s (resume failed)", err),
 					temporary: true,
 				}
 			}
+			src = resumed
 			bytesSoFar = size
 		}
 
-		n, err = c.transferFromOffset(path, nil, src, bytesSoFar)
+		n, err = c.transferFromOffset(ctx, typ, "STOR", path, nil, src, bytesSoFar, total)
 
 		bytesSoFar += n
 
 		if err == nil {
 			break
+		} else if ctx.Err() != nil {
+			return err
 		} else if n == 0 {
+			// start over from the beginning of src if nothing has been sent
+			if srcAt != nil && bytesSoFar == 0 && c.shouldRetry(attempt, err) {
+				if restarted, srcErr := srcAt(0); srcErr == nil {
+					src = restarted
+					continue
+				}
+			}
 			return ftpError{
 				err:       err,
 				temporary: true,
@@ -139,48 +731,125 @@ func (c *Client) Store(path string, src io.Reader) error {
 	return nil
 }
 
-func (c *Client) transferFromOffset(path string, dest io.Writer, src io.Reader, offset int64) (int64, error) {
-	pconn, err := c.getIdleConn()
+// StoreFile stores local file "localPath" into file "remotePath" on the
+// server. Since the local file is an io.Seeker, failed uploads are resumed
+// as described in Store.
+func (c *Client) StoreFile(localPath, remotePath string) error {
+	f, err := os.Open(localPath)
 	if err != nil {
-		return 0, err
+		return ftpError{err: fmt.Errorf("error opening local file: %s", err)}
 	}
 
-	defer c.returnConn(pconn)
+	defer f.Close()
 
-	if err = pconn.setType("I"); err != nil {
-		return 0, err
+	return c.Store(remotePath, f)
+}
+
+// StoreOffset stores bytes read from "src" into file "path" on the server,
+// starting at byte "offset" of the remote file (using "REST"). The caller is
+// responsible for positioning "src" at the corresponding point in the
+// source data. The server must support resuming stream transfers. StoreOffset
+// won't resume a failed upload, but it will verify the remote file's size is
+// offset plus the number of bytes sent if the server supports the SIZE
+// command.
+func (c *Client) StoreOffset(path string, src io.Reader, offset int64) error {
+	if c.config.DefaultTransferType == TransferASCII {
+		return ftpError{err: fmt.Errorf("can't store %s from offset %d in ASCII mode", path, offset)}
 	}
 
-	if offset > 0 {
-		err := pconn.sendCommandExpected(replyFileActionPending, "REST %d", offset)
-		if err != nil {
-			return 0, err
+	if offset > 0 && !c.canResume() {
+		return ftpError{err: fmt.Errorf("can't store %s from offset %d: server doesn't support resuming transfers", path, offset)}
+	}
+
+	n, err := c.transferFromOffset(context.Background(), TransferBinary, "STOR", path, nil, src, offset, -1)
+	if err != nil {
+		return err
+	}
+
+	size, err := c.size(path)
+	if err != nil {
+		return err
+	}
+	if size != -1 && size != offset+n {
+		return ftpError{
+			err:       fmt.Errorf("sent %d bytes from offset %d, but size is %d", n, offset, size),
+			temporary: true,
 		}
 	}
 
-	connGetter, err := pconn.prepareDataConn()
+	return nil
+}
+
+// Append bytes read from "src" to the end of file "path" on the server. The
+// file is created if it doesn't exist. Unlike Store, Append will not attempt
+// to resume a failed upload. Append will verify the remote file grew by the
+// number of bytes sent if the server supports the SIZE command.
+func (c *Client) Append(path string, src io.Reader) error {
+	// fetch existing file size to check against after appending
+	before, err := c.size(path)
 	if err != nil {
-		pconn.debug("error preparing data connection: %s", err)
-		return 0, err
+		return err
 	}
 
-	var cmd string
-	if dest == nil && src != nil {
-		cmd = "STOR"
-	} else if dest != nil && src == nil {
-		cmd = "RETR"
-	} else {
-		panic("this shouldn't happen")
+	n, err := c.transferFromOffset(context.Background(), c.config.DefaultTransferType, "APPE", path, nil, src, 0, -1)
+	if err != nil {
+		return err
 	}
 
-	err = pconn.sendCommandExpected(replyGroupPreliminaryReply, "%s %s", cmd, path)
+	if c.config.DefaultTransferType == TransferASCII {
+		// sizes won't add up
+		return nil
+	}
+
+	after, err := c.size(path)
+	if err != nil {
+		return err
+	}
+
+	// file didn't exist yet (or no SIZE support, in which case after is -1 too)
+	if before == -1 {
+		before = 0
+	}
+
+	if after != -1 && after != before+n {
+		return ftpError{
+			err:       fmt.Errorf("appended %d bytes to %d, but size is %d", n, before, after),
+			temporary: true,
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) transferFromOffset(ctx context.Context, typ TransferType, cmd, path string, dest io.Writer, src io.Reader, offset, total int64) (n int64, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, contextError(err)
+	}
+
+	pconn, err := c.getIdleConn()
 	if err != nil {
 		return 0, err
 	}
 
-	dc, err := connGetter()
+	defer c.returnConn(pconn)
+
+	return c.transferOnConn(ctx, pconn, typ, cmd, path, dest, src, offset, total)
+}
+
+// Like transferFromOffset, but using pconn rather than a connection from
+// the pool.
+func (c *Client) transferOnConn(ctx context.Context, pconn *persistentConn, typ TransferType, cmd, path string, dest io.Writer, src io.Reader, offset, total int64) (n int64, err error) {
+	defer pconn.setContext(ctx)()
+
+	// errors caused by interrupting the connection should report why
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = contextError(ctx.Err())
+		}
+	}()
+
+	dc, err := pconn.openDataCommand(typ, cmd, path, offset)
 	if err != nil {
-		pconn.debug("error getting data connection: %s", err)
 		return 0, err
 	}
 
@@ -193,7 +862,43 @@ func (c *Client) transferFromOffset(path string, dest io.Writer, src io.Reader,
 		src = dc
 	}
 
-	n, err := io.Copy(dest, src)
+	var progress *progressWriter
+	if c.config.ProgressCallback != nil {
+		progress = &progressWriter{
+			w:        dest,
+			cb:       c.config.ProgressCallback,
+			path:     path,
+			total:    total,
+			soFar:    offset,
+			reported: offset,
+		}
+		dest = progress
+	}
+
+	var stopKeepAlive func() (int, error)
+	if c.config.ControlKeepAlive > 0 {
+		stopKeepAlive = pconn.startKeepAlive(c.config.ControlKeepAlive)
+	}
+
+	if c.config.TransferBufferSize > 0 {
+		n, err = io.CopyBuffer(dest, src, make([]byte, c.config.TransferBufferSize))
+	} else {
+		n, err = io.Copy(dest, src)
+	}
+
+	atomic.AddInt64(&c.stats.bytesTransferred, n)
+
+	var noops int
+	if stopKeepAlive != nil {
+		var keepAliveErr error
+		noops, keepAliveErr = stopKeepAlive()
+		if keepAliveErr != nil {
+			pconn.broken = true
+			if err == nil {
+				err = keepAliveErr
+			}
+		}
+	}
 
 	if err != nil {
 		pconn.broken = true
@@ -205,7 +910,7 @@ func (c *Client) transferFromOffset(path string, dest io.Writer, src io.Reader,
 		pconn.debug("error closing data connection: %s", err)
 	}
 
-	code, msg, err := pconn.readResponse()
+	code, msg, err := pconn.readTransferResponse(noops)
 	if err != nil {
 		pconn.debug("error reading response after %s: %s", cmd, err)
 		return n, err
@@ -216,12 +921,65 @@ func (c *Client) transferFromOffset(path string, dest io.Writer, src io.Reader,
 		return n, ftpError{code: code, msg: msg}
 	}
 
+	if progress != nil {
+		progress.report()
+	}
+
 	return n, nil
 }
 
-// Fetch SIZE of file. Returns error only on underlying connection error.
-// If the server doesn't support size, it returns -1 and no error.
-func (c *Client) size(path string) (int64, error) {
+// Minimum number of bytes transferred between progress callbacks.
+const progressInterval = 64 * 1024
+
+// io.Writer wrapper that periodically reports how many bytes have been
+// written to Config.ProgressCallback.
+type progressWriter struct {
+	w        io.Writer
+	cb       func(path string, bytesTransferred, totalBytes int64)
+	path     string
+	total    int64
+	soFar    int64
+	reported int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.soFar += int64(n)
+	if pw.soFar-pw.reported >= progressInterval {
+		pw.report()
+	}
+	return n, err
+}
+
+func (pw *progressWriter) report() {
+	pw.reported = pw.soFar
+	pw.cb(pw.path, pw.soFar, pw.total)
+}
+
+// Returns the number of bytes from seeker's current position to the end of
+// its stream, or -1 if it can't be determined. The seek position is left
+// unchanged.
+func seekerRemaining(seeker io.Seeker) int64 {
+	cur, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
+	}
+
+	if _, err := seeker.Seek(cur, io.SeekStart); err != nil {
+		return -1
+	}
+
+	return end - cur
+}
+
+// Size returns the size of file "path" in bytes using the "SIZE" command.
+// This is cheaper than Stat, but requires the server to support "SIZE".
+func (c *Client) Size(path string) (int64, error) {
 	pconn, err := c.getIdleConn()
 	if err != nil {
 		return -1, err
@@ -229,13 +987,16 @@ func (c *Client) size(path string) (int64, error) {
 
 	defer c.returnConn(pconn)
 
+	return pconn.size(path)
+}
+
+func (pconn *persistentConn) size(path string) (int64, error) {
 	if !pconn.hasFeature("SIZE") {
-		pconn.debug("server doesn't support SIZE")
-		return -1, nil
+		return -1, unsupportedError("SIZE")
 	}
 
-	if err = pconn.setType("I"); err != nil {
-		return 0, err
+	if err := pconn.setType("I"); err != nil {
+		return -1, err
 	}
 
 	code, msg, err := pconn.sendCommand("SIZE %s", path)
@@ -244,19 +1005,263 @@ func (c *Client) size(path string) (int64, error) {
 	}
 
 	if code != replyFileStatus {
-		pconn.debug("unexpected SIZE response: %d (%s)", code, msg)
-		return -1, nil
+		return -1, ftpError{code: code, msg: msg}
 	}
 
 	size, err := strconv.ParseInt(msg, 10, 64)
 	if err != nil {
-		pconn.debug(`failed parsing SIZE response "%s": %s`, msg, err)
-		return -1, nil
+		return -1, ftpError{err: fmt.Errorf("failed parsing SIZE response: %s", msg)}
 	}
 
 	return size, nil
 }
 
+// Checksum algorithms, as named by the HASH command (see
+// https://tools.ietf.org/html/draft-bryan-ftpext-hash-02), along with the
+// older, non-standard command for each.
+var hashAlgorithms = map[string]struct {
+	cmd    string
+	newFn  func() hash.Hash
+	hexLen int
+}{
+	"CRC32":   {"XCRC", func() hash.Hash { return crc32.NewIEEE() }, 8},
+	"MD5":     {"XMD5", md5.New, 32},
+	"SHA-1":   {"XSHA1", sha1.New, 40},
+	"SHA-256": {"XSHA256", sha256.New, 64},
+	"SHA-512": {"XSHA512", sha512.New, 128},
+}
+
+// Preferred algorithms for Config.VerifyChecksum, strongest first.
+var checksumPreference = []string{"SHA-512", "SHA-256", "SHA-1", "MD5", "CRC32"}
+
+// Hash returns the server's checksum of file "path" as lower case hex,
+// computed with algorithm "algo" (one of "CRC32", "MD5", "SHA-1",
+// "SHA-256" or "SHA-512"). The "HASH" command is used if the server
+// advertises the algorithm for it, otherwise the corresponding older
+// command ("XCRC", "XMD5", "XSHA1", etc.) if advertised. Hashing large files
+// can take the server a while, so you may need to increase Config.Timeout.
+func (c *Client) Hash(path, algo string) (string, error) {
+	algo = strings.ToUpper(algo)
+	if _, ok := hashAlgorithms[algo]; !ok {
+		return "", ftpError{err: fmt.Errorf("unknown hash algorithm: %s", algo)}
+	}
+
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return "", err
+	}
+
+	defer c.returnConn(pconn)
+
+	return pconn.hash(path, algo)
+}
+
+// CRC32 returns the server's CRC-32 (IEEE) checksum of file "path" using
+// "XCRC" (or "HASH", see Client.Hash), without downloading it.
+func (c *Client) CRC32(path string) (uint32, error) {
+	sum, err := c.Hash(path, "CRC32")
+	if err != nil {
+		return 0, err
+	}
+
+	crc, err := strconv.ParseUint(sum, 16, 32)
+	if err != nil {
+		return 0, ftpError{err: fmt.Errorf("failed parsing CRC32 %s: %s", sum, err)}
+	}
+
+	return uint32(crc), nil
+}
+
+// MD5 returns the server's MD5 checksum of file "path" as lower case hex
+// using "XMD5" (or "HASH", see Client.Hash), without downloading it.
+func (c *Client) MD5(path string) (string, error) {
+	return c.Hash(path, "MD5")
+}
+
+// The strongest checksum algorithm the server supports, or "" if none.
+func (c *Client) checksumAlgorithm() (string, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return "", err
+	}
+
+	defer c.returnConn(pconn)
+
+	for _, algo := range checksumPreference {
+		if pconn.hasHashCommand(algo) || pconn.hasFeature(hashAlgorithms[algo].cmd) {
+			return algo, nil
+		}
+	}
+
+	pconn.debug("server doesn't support any checksum commands")
+	return "", nil
+}
+
+// Whether the server lists algo in its "HASH" feature, which looks like
+// "SHA-256*;SHA-1;MD5;CRC32" (the current algorithm is starred).
+func (pconn *persistentConn) hasHashCommand(algo string) bool {
+	algos, found := pconn.features["HASH"]
+	if !found {
+		return false
+	}
+
+	for _, a := range strings.Split(algos, ";") {
+		if strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(a), "*")) == algo {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (pconn *persistentConn) hash(path, algo string) (string, error) {
+	info := hashAlgorithms[algo]
+
+	if pconn.hasHashCommand(algo) {
+		if err := pconn.sendCommandExpected(replyGroupPositiveCompletion, "OPTS HASH %s", algo); err != nil {
+			return "", err
+		}
+
+		code, msg, err := pconn.sendCommand("HASH %s", path)
+		if err != nil {
+			return "", err
+		}
+
+		if code != replyFileStatus {
+			return "", ftpError{code: code, msg: msg}
+		}
+
+		// e.g. "SHA-256 0-49 169cd22282da7f147cb491e559e9dd filename"
+		fields := strings.Fields(msg)
+		if len(fields) < 3 || !isHex(fields[2]) {
+			return "", ftpError{err: fmt.Errorf("failed parsing HASH response: %s", msg)}
+		}
+
+		return strings.ToLower(fields[2]), nil
+	}
+
+	if !pconn.hasFeature(info.cmd) {
+		return "", unsupportedError(info.cmd)
+	}
+
+	code, msg, err := pconn.sendCommand("%s %s", info.cmd, path)
+	if err != nil {
+		return "", err
+	}
+
+	if !positiveCompletionReply(code) {
+		return "", ftpError{code: code, msg: msg}
+	}
+
+	sum := parseHashReply(msg, info.hexLen)
+	if sum == "" {
+		return "", ftpError{err: fmt.Errorf("failed parsing %s response: %s", info.cmd, msg)}
+	}
+
+	return sum, nil
+}
+
+// Find the checksum in the reply to one of the older hash commands, whose
+// format varies by server, e.g. "1A2B3C4D", "filename 1A2B3C4D",
+// "1A2B3C4D filename" or "XCRC successful: 0x1A2B3C4D". The checksum is the
+// first field of the expected length that is hex. Returns "" if there is
+// none.
+func parseHashReply(msg string, hexLen int) string {
+	fields := strings.Fields(msg)
+
+	for _, field := range fields {
+		field = strings.TrimRight(field, ".,;")
+		if len(field) == hexLen+2 && (strings.HasPrefix(field, "0x") || strings.HasPrefix(field, "0X")) {
+			field = field[2:]
+		}
+
+		if len(field) == hexLen && isHex(field) {
+			return strings.ToLower(field)
+		}
+	}
+
+	return ""
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ChecksumWriter passes writes through to another io.Writer while computing
+// a checksum of the bytes written, e.g. to compare against Client.Hash.
+type ChecksumWriter struct {
+	w    io.Writer
+	algo string
+	h    hash.Hash
+}
+
+// NewChecksumWriter returns a ChecksumWriter writing to w and computing a
+// checksum with algorithm "algo" (see Client.Hash for supported values).
+func NewChecksumWriter(w io.Writer, algo string) (*ChecksumWriter, error) {
+	algo = strings.ToUpper(algo)
+	info, ok := hashAlgorithms[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm: %s", algo)
+	}
+
+	return &ChecksumWriter{w: w, algo: algo, h: info.newFn()}, nil
+}
+
+// Write writes p to the underlying writer, adding the bytes it accepted to
+// the checksum.
+func (cw *ChecksumWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.h.Write(p[:n])
+	return n, err
+}
+
+// Algorithm returns the checksum algorithm, e.g. "SHA-256".
+func (cw *ChecksumWriter) Algorithm() string {
+	return cw.algo
+}
+
+// Sum returns the checksum of the bytes written so far as lower case hex.
+func (cw *ChecksumWriter) Sum() string {
+	return hex.EncodeToString(cw.h.Sum(nil))
+}
+
+// Fetch SIZE of file. Returns error only on underlying connection error.
+// If the server doesn't support size, it returns -1 and no error.
+func (c *Client) size(path string) (int64, error) {
+	pconn, err := c.getIdleConn()
+	if err != nil {
+		return -1, err
+	}
+
+	defer c.returnConn(pconn)
+
+	size, err := pconn.size(path)
+	if err != nil && !pconn.broken {
+		// the server doesn't support SIZE or couldn't tell us the size
+		pconn.debug("error getting size: %s", err)
+		return -1, nil
+	}
+
+	return size, err
+}
+
+func contextError(err error) error {
+	return ftpError{
+		err:     err,
+		timeout: err == context.DeadlineExceeded,
+	}
+}
+
 func (c *Client) canResume() bool {
 	pconn, err := c.getIdleConn()
 	if err != nil {
@@ -5,12 +5,23 @@
 package goftp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/textproto"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -57,6 +68,338 @@ func TestRetrieve(t *testing.T) {
 	}
 }
 
+func TestRetrieveFrom(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+
+		err = c.RetrieveFrom("subdir/1234.bin", buf, 2)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRetrieveOffset(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+
+		n, err := c.RetrieveOffset("subdir/1234.bin", buf, 1)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 3 || !bytes.Equal([]byte{2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %d %v", n, buf.Bytes())
+		}
+
+		// offset at end of file is a no-op
+		buf.Reset()
+		n, err = c.RetrieveOffset("subdir/1234.bin", buf, 4)
+
+		if err != nil || n != 0 || buf.Len() != 0 {
+			t.Errorf("Got %d %v %v", n, buf.Bytes(), err)
+		}
+
+		// offset past end of file is an error
+		_, err = c.RetrieveOffset("subdir/1234.bin", buf, 5)
+
+		if err == nil {
+			t.Error("Expected error for offset past end of file")
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRetrieveToFile(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		localPath := "testroot/git-ignored/retrieve-to-file"
+		os.Remove(localPath)
+
+		// partial file should be cleaned up on error
+		if err := c.RetrieveToFile("doesnt-exist", localPath); err == nil {
+			t.Error("Expected error about not existing")
+		}
+
+		if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+			t.Errorf("Expected local file to be removed, got %v", err)
+		}
+
+		if err := c.RetrieveToFile("subdir/1234.bin", localPath); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadFile(localPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, got) {
+			t.Errorf("Got %v", got)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestStoreFile(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove("testroot/git-ignored/store-file")
+
+		if err := c.StoreFile("testroot/doesnt-exist", "git-ignored/store-file"); err == nil {
+			t.Error("Expected error about local file not existing")
+		}
+
+		if err := c.StoreFile("testroot/subdir/1234.bin", "git-ignored/store-file"); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadFile("testroot/git-ignored/store-file")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, got) {
+			t.Errorf("Got %v", got)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestASCII(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove("testroot/git-ignored/ascii.txt")
+
+		text := []byte("hello\r\nworld\r\n")
+
+		if err := c.StoreASCII("git-ignored/ascii.txt", bytes.NewReader(text)); err != nil {
+			t.Fatal(err)
+		}
+
+		// server may or may not translate line endings when storing, but
+		// should translate back to CRLF when retrieving
+		buf := new(bytes.Buffer)
+		if err := c.RetrieveASCII("git-ignored/ascii.txt", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(text, buf.Bytes()) {
+			t.Errorf("Got %q", buf.Bytes())
+		}
+
+		// make sure we switch back to binary
+		buf.Reset()
+		if err := c.Retrieve("subdir/1234.bin", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRetrieveAll(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		destDir := "testroot/git-ignored/retrieve-all"
+		os.RemoveAll(destDir)
+
+		err = c.RetrieveAll([]string{"subdir/1234.bin", "doesnt-exist", "lorem.txt"}, destDir, 2)
+
+		allErr, ok := err.(RetrieveAllError)
+		if !ok {
+			t.Fatalf("Expected RetrieveAllError, got %v", err)
+		}
+
+		if len(allErr.Errors) != 1 || allErr.Errors["doesnt-exist"] == nil {
+			t.Errorf("Got %v", allErr.Errors)
+		}
+
+		got, err := ioutil.ReadFile(destDir + "/subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, got) {
+			t.Errorf("Got %v", got)
+		}
+
+		if _, err := os.Stat(destDir + "/lorem.txt"); err != nil {
+			t.Error(err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.Open("doesnt-exist"); err == nil {
+			t.Error("Expected error about not existing")
+		}
+
+		r, err := c.Open("subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, got) {
+			t.Errorf("Got %v", got)
+		}
+
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove("testroot/git-ignored/create")
+
+		w, err := c.Create("git-ignored/create")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write([]byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadFile("testroot/git-ignored/create")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{0, 1, 2}, got) {
+			t.Errorf("Got %v", got)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestStoreOffset(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove("testroot/git-ignored/store-offset")
+
+		if err := c.Store("git-ignored/store-offset", bytes.NewReader([]byte{1, 2})); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.StoreOffset("git-ignored/store-offset", bytes.NewReader([]byte{3, 4}), 2); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadFile("testroot/git-ignored/store-offset")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, got) {
+			t.Errorf("Got %v", got)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
 func TestRetrievePASV(t *testing.T) {
 	for _, addr := range ftpdAddrs {
 		if strings.HasPrefix(addr, "[::1]") {
@@ -69,40 +412,796 @@ func TestRetrievePASV(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		// server doesn't support EPSV
-		c.config.stubResponses = map[string]stubResponse{
-			"EPSV": stubResponse{500, `'EPSV': command not understood.`},
+		// server doesn't support EPSV
+		c.config.ResponseOverrides = map[string]StubResponse{
+			"EPSV": StubResponse{500, `'EPSV': command not understood.`},
+		}
+
+		buf := new(bytes.Buffer)
+		err = c.Retrieve("subdir/1234.bin", buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRetrieveIgnorePASVAddress(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		if strings.HasPrefix(addr, "[::1]") {
+			// PASV can't work with IPv6
+			continue
+		}
+
+		config := goftpConfig
+		config.IgnorePASVAddress = true
+
+		// server doesn't support EPSV
+		config.ResponseOverrides = map[string]StubResponse{
+			"EPSV": StubResponse{500, `'EPSV': command not understood.`},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		err = c.Retrieve("subdir/1234.bin", buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRewritePassiveAddr(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		var (
+			calls     []string
+			rewriteTo string
+		)
+
+		config := goftpConfig
+		config.RewritePassiveAddr = func(reported, control string) string {
+			calls = append(calls, control)
+			if rewriteTo != "" {
+				return rewriteTo
+			}
+			return reported
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("subdir/1234.bin", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if len(calls) == 0 || calls[0] != addr {
+			t.Errorf("Got %v", calls)
+		}
+
+		// rewritten address is actually used
+		rewriteTo = "127.0.0.1:1"
+
+		err = c.Retrieve("subdir/1234.bin", ioutil.Discard)
+		if dce, ok := err.(DataConnError); !ok || dce.Addr != rewriteTo || dce.Active {
+			t.Errorf("Expected DataConnError, got %#v", err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRetrieveUnreachableEPSV(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		if strings.HasPrefix(addr, "[::1]") {
+			// PASV can't work with IPv6
+			continue
+		}
+
+		config := goftpConfig
+		config.ConnectionsPerHost = 1
+
+		// EPSV hands out a port nothing is listening on
+		config.ResponseOverrides = map[string]StubResponse{
+			"EPSV": StubResponse{229, "Entering Extended Passive Mode (|||1|)"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			buf := new(bytes.Buffer)
+			err = c.Retrieve("subdir/1234.bin", buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+				t.Errorf("Got %v", buf.Bytes())
+			}
+		}
+
+		pconn := <-c.freeConnCh
+		if !pconn.epsvNotSupported {
+			t.Error("Expected EPSV to be disabled on the connection")
+		}
+		c.freeConnCh <- pconn
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRetrieveUnreachableEPSVAndPASV(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ConnectionsPerHost = 1
+
+		// neither passive mode hands out a usable port
+		config.ResponseOverrides = map[string]StubResponse{
+			"EPSV": StubResponse{229, "Entering Extended Passive Mode (|||1|)"},
+			"PASV": StubResponse{227, "Entering Passive Mode (127,0,0,1,0,1)"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Retrieve("subdir/1234.bin", new(bytes.Buffer)); err == nil {
+			t.Error("Expected error")
+		}
+
+		// PASV didn't work (or can't, over IPv6), so EPSV is still used
+		pconn := <-c.freeConnCh
+		if pconn.epsvNotSupported {
+			t.Error("Expected EPSV to still be enabled on the connection")
+		}
+		c.freeConnCh <- pconn
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRetrieveContextCancelMidTransfer(t *testing.T) {
+	for _, mode := range []TransferMode{PassiveOnly, ActiveOnly} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// closed once the transfer is underway
+		started := make(chan struct{})
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			reader := textproto.NewReader(bufio.NewReader(conn))
+			conn.Write([]byte("220 Welcome\r\n"))
+
+			var dataLn net.Listener
+
+			for {
+				line, err := reader.ReadLine()
+				if err != nil {
+					return
+				}
+
+				var reply string
+				switch strings.Fields(line)[0] {
+				case "USER":
+					reply = "331 Need password"
+				case "PASS":
+					reply = "230 Logged in"
+				case "TYPE":
+					reply = "200 Type set"
+				case "EPRT", "PORT":
+					reply = "200 Port set"
+				case "EPSV":
+					dataLn, err = net.Listen("tcp", "127.0.0.1:0")
+					if err != nil {
+						return
+					}
+					port := dataLn.Addr().(*net.TCPAddr).Port
+					reply = fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)", port)
+				case "RETR":
+					conn.Write([]byte("150 Here it comes\r\n"))
+
+					if dataLn == nil {
+						// never connect to the active port
+						close(started)
+						ioutil.ReadAll(conn)
+						return
+					}
+
+					dc, err := dataLn.Accept()
+					dataLn.Close()
+					if err != nil {
+						return
+					}
+					defer dc.Close()
+
+					// send some data, then stall until the client gives up
+					dc.Write([]byte{1, 2, 3, 4})
+					close(started)
+					ioutil.ReadAll(dc)
+					return
+				case "QUIT":
+					reply = "221 Goodbye"
+				default:
+					reply = "502 Command not implemented"
+				}
+
+				conn.Write([]byte(reply + "\r\n"))
+			}
+		}()
+
+		config := goftpConfig
+		config.TransferMode = mode
+
+		c, err := DialConfig(config, ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		go func() {
+			<-started
+			cancel()
+		}()
+
+		err = c.RetrieveContext(ctx, "foo", ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), "canceled") {
+			t.Errorf("Got %v", err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+
+		cancel()
+		c.Close()
+		ln.Close()
+	}
+}
+
+func TestRetrieveUnusablePASVAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dataLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := textproto.NewReader(bufio.NewReader(conn))
+		conn.Write([]byte("220 Welcome\r\n"))
+
+		for {
+			line, err := reader.ReadLine()
+			if err != nil {
+				return
+			}
+
+			var reply string
+			switch strings.Fields(line)[0] {
+			case "USER":
+				reply = "331 Need password"
+			case "PASS":
+				reply = "230 Logged in"
+			case "TYPE":
+				reply = "200 Type set"
+			case "RETR":
+				dc, err := dataLn.Accept()
+				if err != nil {
+					reply = "425 Can't open data connection"
+					break
+				}
+				conn.Write([]byte("150 Here it comes\r\n"))
+				dc.Write([]byte{1, 2, 3, 4})
+				dc.Close()
+				reply = "226 Done"
+			case "QUIT":
+				reply = "221 Goodbye"
+			default:
+				reply = "502 Command not implemented"
+			}
+
+			conn.Write([]byte(reply + "\r\n"))
+		}
+	}()
+
+	port := dataLn.Addr().(*net.TCPAddr).Port
+
+	config := goftpConfig
+	config.ConnectionsPerHost = 1
+	config.DataTimeout = 100 * time.Millisecond
+
+	// the PASV reply has an unroutable address, but the right port
+	config.ResponseOverrides = map[string]StubResponse{
+		"EPSV": {500, "EPSV not understood"},
+		"PASV": {227, fmt.Sprintf("Entering Passive Mode (192,0,2,1,%d,%d)", port>>8, port&0xff)},
+	}
+
+	c, err := DialConfig(config, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("foo", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		pconn := <-c.freeConnCh
+		if !pconn.pasvAddressUnusable {
+			t.Error("Expected the PASV address to be marked unusable")
+		}
+		c.freeConnCh <- pconn
+	}
+
+	// the control host stops working, so the PASV address is tried again
+	dataLn.Close()
+
+	if err := c.Retrieve("foo", new(bytes.Buffer)); err == nil {
+		t.Error("Expected error")
+	}
+
+	pconn := <-c.freeConnCh
+	if pconn.pasvAddressUnusable {
+		t.Error("Expected the PASV address to be probed again")
+	}
+	c.freeConnCh <- pconn
+
+	if c.numOpenConns() != len(c.freeConnCh) {
+		t.Error("Leaked a connection")
+	}
+}
+
+func TestRetrievePassivePreferred(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.TransferMode = PassivePreferred
+
+		// passive mode doesn't work, so we should fall back to active
+		config.ResponseOverrides = map[string]StubResponse{
+			"EPSV": StubResponse{500, `'EPSV': command not understood.`},
+			"PASV": StubResponse{500, `'PASV': command not understood.`},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			buf := new(bytes.Buffer)
+			err = c.Retrieve("subdir/1234.bin", buf)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+				t.Errorf("Got %v", buf.Bytes())
+			}
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	contents := []byte{1, 2, 3, 4}
+	md5Sum := md5.Sum(contents)
+	sha256Sum := sha256.Sum256(contents)
+
+	cases := []struct {
+		stubs map[string]StubResponse
+		valid bool
+	}{
+		{
+			map[string]StubResponse{
+				"FEAT":                 {211, "Extensions supported:\n SIZE\n XCRC\n XMD5\nEND"},
+				"XMD5 subdir/1234.bin": {250, hex.EncodeToString(md5Sum[:])},
+			},
+			true,
+		},
+		{
+			map[string]StubResponse{
+				"FEAT":                 {211, "Extensions supported:\n SIZE\n XMD5\nEND"},
+				"XMD5 subdir/1234.bin": {250, "subdir/1234.bin 0123456789ABCDEF0123456789ABCDEF"},
+			},
+			false,
+		},
+		{
+			map[string]StubResponse{
+				"FEAT":                 {211, "Extensions supported:\n SIZE\n HASH SHA-1*;SHA-256;MD5\nEND"},
+				"OPTS HASH SHA-256":    {200, "SHA-256"},
+				"HASH subdir/1234.bin": {213, "SHA-256 0-4 " + hex.EncodeToString(sha256Sum[:]) + " subdir/1234.bin"},
+			},
+			true,
+		},
+	}
+
+	for _, addr := range ftpdAddrs {
+		for _, tc := range cases {
+			config := goftpConfig
+			config.VerifyChecksum = true
+			config.ResponseOverrides = tc.stubs
+
+			c, err := DialConfig(config, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := new(bytes.Buffer)
+			err = c.Retrieve("subdir/1234.bin", buf)
+			if tc.valid && err != nil {
+				t.Error(err)
+			} else if !tc.valid && (err == nil || !strings.Contains(err.Error(), "checksum mismatch")) {
+				t.Errorf("Expected checksum mismatch, got %v", err)
+			}
+
+			if !bytes.Equal(contents, buf.Bytes()) {
+				t.Errorf("Got %v", buf.Bytes())
+			}
+
+			if c.numOpenConns() != len(c.freeConnCh) {
+				t.Error("Leaked a connection")
+			}
+		}
+	}
+}
+
+func TestCRC32AndMD5(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ResponseOverrides = map[string]StubResponse{
+			"FEAT":                 {211, "Extensions supported:\n SIZE\n XCRC\nEND"},
+			"XCRC subdir/1234.bin": {250, "subdir/1234.bin B63CFBCD"},
+		}
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		crc, err := c.CRC32("subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if crc != crc32.ChecksumIEEE([]byte{1, 2, 3, 4}) {
+			t.Errorf("Got %08x", crc)
+		}
+
+		// XMD5 not advertised
+		_, err = c.MD5("subdir/1234.bin")
+		if err == nil || !strings.Contains(err.Error(), "doesn't support XMD5") {
+			t.Errorf("Got %v", err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestParseHashReply(t *testing.T) {
+	cases := []struct {
+		msg    string
+		hexLen int
+		exp    string
+	}{
+		{"1A2B3C4D", 8, "1a2b3c4d"},
+		{"0x1A2B3C4D", 8, "1a2b3c4d"},
+		{"XCRC successful: 1a2b3c4d.", 8, "1a2b3c4d"},
+		{"some/file.bin 1A2B3C4D", 8, "1a2b3c4d"},
+		{"0123456789abcdef0123456789abcdef some/file.bin", 32, "0123456789abcdef0123456789abcdef"},
+		{"1A2B3C4D", 32, ""},
+		{"not a checksum", 8, ""},
+	}
+
+	for _, c := range cases {
+		if got := parseHashReply(c.msg, c.hexLen); got != c.exp {
+			t.Errorf("%q: expected %q, got %q", c.msg, c.exp, got)
+		}
+	}
+}
+
+func TestChecksumWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	cw, err := NewChecksumWriter(buf, "crc32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io.WriteString(cw, "hello ")
+	io.WriteString(cw, "world")
+
+	if buf.String() != "hello world" {
+		t.Errorf("Got %q", buf.String())
+	}
+
+	if cw.Algorithm() != "CRC32" || cw.Sum() != "0d4a1185" {
+		t.Errorf("Got %s %s", cw.Algorithm(), cw.Sum())
+	}
+
+	if _, err := NewChecksumWriter(buf, "rot13"); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// io.Writer that records the largest write
+type maxWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (w *maxWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		w.max = len(p)
+	}
+	return w.buf.Write(p)
+}
+
+func TestTransferBufferSize(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.TransferBufferSize = 3
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := new(maxWriter)
+		if err := c.Retrieve("subdir/1234.bin", w); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, w.buf.Bytes()) {
+			t.Errorf("Got %v", w.buf.Bytes())
+		}
+
+		if w.max != 3 {
+			t.Errorf("Expected writes of at most 3 bytes, got %d", w.max)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestRetrieveParallel(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 1MB of random data, not evenly divisible into chunks
+		buf := make([]byte, 1024*1024+3)
+		randomBytes(buf)
+
+		if err := ioutil.WriteFile("testroot/git-ignored/parallel", buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, chunks := range []int{1, 4, 100} {
+			f, err := ioutil.TempFile("", "goftp")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.RetrieveParallel("git-ignored/parallel", f, chunks)
+			f.Close()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(f.Name())
+			os.Remove(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(buf, got) {
+				t.Errorf("%d chunks: retrieved %d bytes, which don't match", chunks, len(got))
+			}
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+// io.WriterAt backed by a byte slice
+type sliceWriterAt []byte
+
+func (s sliceWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(s[off:], p), nil
+}
+
+func TestOffsetWriter(t *testing.T) {
+	dest := make(sliceWriterAt, 8)
+
+	w := &offsetWriter{w: dest, offset: 2, limit: 6}
+
+	if n, err := w.Write([]byte{1, 2}); n != 2 || err != nil {
+		t.Errorf("Got %d %v", n, err)
+	}
+
+	if n, err := w.Write([]byte{3, 4, 5}); n != 2 || err != errChunkDone {
+		t.Errorf("Got %d %v", n, err)
+	}
+
+	if !bytes.Equal(dest, []byte{0, 0, 1, 2, 3, 4, 0, 0}) {
+		t.Errorf("Got %v", dest)
+	}
+}
+
+func TestRetrieveActive(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		activeConfig := goftpConfig
+		activeConfig.ActiveTransfers = true
+
+		// pretend server doesn't support passive mode to make sure we aren't
+		// still using it
+		activeConfig.ResponseOverrides = map[string]StubResponse{
+			"EPSV": StubResponse{500, `'EPSV': command not understood.`},
+			"PASV": StubResponse{500, `'PASV': command not understood.`},
+		}
+
+		c, err := DialConfig(activeConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		err = c.Retrieve("subdir/1234.bin", buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestActiveListenerClosed(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			port  int
+			path  string
+			stubs map[string]StubResponse
+		}{
+			// server never connects since the file doesn't exist
+			{52110, "doesnt-exist", nil},
+			// server rejects PORT/EPRT (52111 is 203*256 + 143)
+			{52111, "subdir/1234.bin", map[string]StubResponse{
+				"PORT 127,0,0,1,203,143": {500, "Illegal PORT command"},
+				"EPRT |2|::1|52111|":     {500, "Illegal EPRT command"},
+			}},
 		}
 
-		buf := new(bytes.Buffer)
-		err = c.Retrieve("subdir/1234.bin", buf)
+		for _, tc := range cases {
+			activeConfig := goftpConfig
+			activeConfig.ActiveTransfers = true
+			activeConfig.ActivePortRange = [2]int{tc.port, tc.port}
+			activeConfig.ResponseOverrides = tc.stubs
 
-		if err != nil {
-			t.Fatal(err)
-		}
+			c, err := DialConfig(activeConfig, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
-			t.Errorf("Got %v", buf.Bytes())
-		}
+			if err := c.Retrieve(tc.path, ioutil.Discard); err == nil {
+				t.Errorf("%s: expected error", tc.path)
+			}
 
-		if c.numOpenConns() != len(c.freeConnCh) {
-			t.Error("Leaked a connection")
+			l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(tc.port)))
+			if err != nil {
+				t.Errorf("%s: listener leaked: %s", tc.path, err)
+			} else {
+				l.Close()
+			}
+
+			if c.numOpenConns() != len(c.freeConnCh) {
+				t.Error("Leaked a connection")
+			}
 		}
 	}
 }
 
-func TestRetrieveActive(t *testing.T) {
+func TestRetrieveActivePortRange(t *testing.T) {
 	for _, addr := range ftpdAddrs {
-		activeConfig := goftpConfig
-		activeConfig.ActiveTransfers = true
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		// pretend server doesn't support passive mode to make sure we aren't
-		// still using it
-		activeConfig.stubResponses = map[string]stubResponse{
-			"EPSV": stubResponse{500, `'EPSV': command not understood.`},
-			"PASV": stubResponse{500, `'PASV': command not understood.`},
+		// occupy the first port in the range so we have to skip it
+		taken, err := net.Listen("tcp", net.JoinHostPort(host, "52100"))
+		if err != nil {
+			t.Fatal(err)
 		}
 
+		activeConfig := goftpConfig
+		activeConfig.ActiveTransfers = true
+		activeConfig.ActivePortRange = [2]int{52100, 52101}
+
 		c, err := DialConfig(activeConfig, addr)
 		if err != nil {
 			t.Fatal(err)
@@ -122,6 +1221,20 @@ func TestRetrieveActive(t *testing.T) {
 		if c.numOpenConns() != len(c.freeConnCh) {
 			t.Error("Leaked a connection")
 		}
+
+		// no free ports left in range
+		activeConfig.ActivePortRange = [2]int{52100, 52100}
+		c, err = DialConfig(activeConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Retrieve("subdir/1234.bin", new(bytes.Buffer))
+		if err == nil || !strings.Contains(err.Error(), "in use") {
+			t.Errorf("expected port range exhausted error, got %v", err)
+		}
+
+		taken.Close()
 	}
 }
 
@@ -214,6 +1327,69 @@ func TestResumeRetrieveOnReadError(t *testing.T) {
 	}
 }
 
+func TestRetrieveProgress(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		type progress struct {
+			path            string
+			soFar, expected int64
+		}
+
+		var got []progress
+
+		config := goftpConfig
+		config.ProgressCallback = func(path string, soFar, expected int64) {
+			got = append(got, progress{path, soFar, expected})
+		}
+
+		c, err := DialConfig(config, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// fail part way through so we resume, and make sure progress is
+		// cumulative across attempts
+		buf := new(testWriter)
+
+		buf.cb = func(p []byte) (int, error) {
+			if len(p) <= 2 {
+				return len(p), nil
+			}
+			return 2, errors.New("too many bytes to handle")
+		}
+
+		err = c.Retrieve("subdir/1234.bin", buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual([]progress{{"subdir/1234.bin", 4, 4}}, got) {
+			t.Errorf("Got %v", got)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestSeekerRemaining(t *testing.T) {
+	r := bytes.NewReader([]byte{1, 2, 3, 4})
+	if _, err := r.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := seekerRemaining(r); n != 3 {
+		t.Errorf("Got %d", n)
+	}
+
+	// position is left alone
+	if pos, _ := r.Seek(0, io.SeekCurrent); pos != 1 {
+		t.Errorf("Got position %d", pos)
+	}
+}
+
 func TestStore(t *testing.T) {
 	for _, addr := range ftpdAddrs {
 		c, err := DialConfig(goftpConfig, addr)
@@ -257,9 +1433,9 @@ func TestStoreActive(t *testing.T) {
 
 		// pretend server doesn't support passive mode to make sure we aren't
 		// still using it
-		activeConfig.stubResponses = map[string]stubResponse{
-			"EPSV": stubResponse{500, `'EPSV': command not understood.`},
-			"PASV": stubResponse{500, `'PASV': command not understood.`},
+		activeConfig.ResponseOverrides = map[string]StubResponse{
+			"EPSV": StubResponse{500, `'EPSV': command not understood.`},
+			"PASV": StubResponse{500, `'PASV': command not understood.`},
 		}
 
 		c, err := DialConfig(activeConfig, addr)
@@ -296,6 +1472,72 @@ func TestStoreActive(t *testing.T) {
 	}
 }
 
+func TestAppend(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove("testroot/git-ignored/foo")
+
+		// creates the file if it doesn't exist
+		err = c.Append("git-ignored/foo", bytes.NewReader([]byte{1, 2}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Append("git-ignored/foo", bytes.NewReader([]byte{3, 4}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := ioutil.ReadFile("testroot/git-ignored/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, stored) {
+			t.Errorf("Got %v", stored)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size, err := c.Size("subdir/1234.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size != 4 {
+			t.Errorf("Got %d", size)
+		}
+
+		_, err = c.Size("doesnt-exist")
+		if err == nil {
+			t.Error("expected error for missing file")
+		} else if err.(Error).Code() != replyFileError {
+			t.Errorf("Got %s", err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
 func TestStoreError(t *testing.T) {
 	for _, addr := range ftpdAddrs {
 		c, err := DialConfig(goftpConfig, addr)
@@ -411,6 +1653,154 @@ func TestResumeStoreOnWriteError(t *testing.T) {
 	}
 }
 
+// io.ReadCloser that isn't an io.Seeker (used to test StoreReader)
+type testReadCloser struct {
+	io.Reader
+	closed bool
+}
+
+func (rc *testReadCloser) Close() error {
+	rc.closed = true
+	return nil
+}
+
+func TestResumeStoreReader(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 10MB of random data
+		buf := make([]byte, 10*1024*1024)
+		randomBytes(buf)
+
+		var (
+			closed  bool
+			offsets []int64
+			readers []*testReadCloser
+		)
+
+		srcAt := func(offset int64) (io.Reader, error) {
+			offsets = append(offsets, offset)
+
+			seeker := &testSeeker{
+				buf: bytes.NewReader(buf[offset:]),
+				cb: func(readSoFar int) {
+					if readSoFar > 5*1024*1024 && !closed {
+						// close all connections half way through upload
+						time.Sleep(100 * time.Millisecond)
+
+						c.Close()
+						c.closed = false
+						closed = true
+					}
+				},
+			}
+
+			rc := &testReadCloser{Reader: seeker}
+			readers = append(readers, rc)
+			return rc, nil
+		}
+
+		os.Remove("testroot/git-ignored/big")
+
+		err = c.StoreReader("git-ignored/big", srcAt)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := ioutil.ReadFile("testroot/git-ignored/big")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf, stored) {
+			t.Errorf("buf was %d, stored was %d", len(buf), len(stored))
+		}
+
+		if len(offsets) != 2 || offsets[0] != 0 || offsets[1] == 0 {
+			t.Errorf("Got offsets %v", offsets)
+		}
+
+		for i, rc := range readers {
+			if !rc.closed {
+				t.Errorf("Reader %d wasn't closed", i)
+			}
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
+func TestStoreContextCancel(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// already cancelled context shouldn't even start a transfer
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err = c.StoreContext(ctx, "git-ignored/big", bytes.NewReader([]byte{1, 2, 3, 4}))
+		if err == nil {
+			t.Error("expected error storing with cancelled context")
+		}
+
+		// 10MB of random data
+		buf := make([]byte, 10*1024*1024)
+		randomBytes(buf)
+
+		ctx, cancel = context.WithCancel(context.Background())
+
+		var cancelledAt time.Time
+
+		seeker := &testSeeker{
+			buf: bytes.NewReader(buf),
+			cb: func(readSoFar int) {
+				if readSoFar > 1024*1024 && cancelledAt.IsZero() {
+					cancelledAt = time.Now()
+					cancel()
+				}
+			},
+		}
+
+		os.Remove("testroot/git-ignored/big")
+
+		err = c.StoreContext(ctx, "git-ignored/big", seeker)
+
+		if err == nil {
+			t.Fatal("expected error after cancelling context")
+		}
+
+		if delta := time.Now().Sub(cancelledAt); delta > 100*time.Millisecond {
+			t.Errorf("took %s to abort transfer", delta)
+		}
+
+		// the interrupted connection shouldn't be reused
+		buf2 := new(bytes.Buffer)
+		err = c.RetrieveContext(context.Background(), "subdir/1234.bin", buf2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf2.Bytes()) {
+			t.Errorf("Got %v", buf2.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
+
 func TestEmptyLinesFeat(t *testing.T) {
 	for _, addr := range ftpdAddrs {
 		c, err := DialConfig(goftpConfig, addr)
@@ -419,8 +1809,8 @@ func TestEmptyLinesFeat(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		c.config.stubResponses = map[string]stubResponse{
-			"FEAT": {code: 211, msg: "Extensions supported:\n EPRT\n EPSV\n\nEND"},
+		c.config.ResponseOverrides = map[string]StubResponse{
+			"FEAT": {Code: 211, Message: "Extensions supported:\n EPRT\n EPSV\n\nEND"},
 		}
 
 		// stat the file so the client asks for features
@@ -430,3 +1820,61 @@ func TestEmptyLinesFeat(t *testing.T) {
 		}
 	}
 }
+
+// io.Writer that sleeps on each write to slow down transfers
+type slowWriter struct {
+	bytes.Buffer
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.Buffer.Write(p)
+}
+
+func TestControlKeepAlive(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		config := goftpConfig
+		config.ConnectionsPerHost = 1
+		config.ControlKeepAlive = 5 * time.Millisecond
+
+		c, err := DialConfig(config, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := c.Stats().CommandsSent
+
+		w := &slowWriter{delay: 50 * time.Millisecond}
+		if err := c.Retrieve("subdir/1234.bin", w); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, w.Bytes()) {
+			t.Errorf("Got %v", w.Bytes())
+		}
+
+		// SIZE, TYPE, PASV/EPSV, RETR etc. plus some NOOPs
+		if sent := c.Stats().CommandsSent - before; sent < 6 {
+			t.Errorf("Expected keep-alive NOOPs, only %d commands sent", sent)
+		}
+
+		// make sure the control connection is still in sync
+		if err := c.Noop(); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := c.Retrieve("subdir/1234.bin", buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal([]byte{1, 2, 3, 4}, buf.Bytes()) {
+			t.Errorf("Got %v", buf.Bytes())
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}
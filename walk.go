@@ -0,0 +1,162 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// WalkOptions controls the behavior of WalkDir.
+type WalkOptions struct {
+	// Maximum number of directories to list concurrently. Defaults to, and is
+	// capped at, the size of the Client's connection pool.
+	Concurrency int
+
+	// Descend into symlinks that point to directories. Note that symlink cycles
+	// are not detected.
+	FollowSymlinks bool
+}
+
+// WalkDir walks the file tree rooted at "root", listing directories in
+// parallel, and calls fn for each file or directory in the tree (not
+// including root itself). See http://golang.org/pkg/path/filepath/#WalkFunc
+// for fn's interface: errors listing a directory are passed to fn, and
+// returning filepath.SkipDir skips a directory (or the remaining entries of
+// the current directory, if returned for a file). Calls to fn are
+// serialized, but the order in which directories are visited is not
+// defined.
+func (c *Client) WalkDir(root string, fn filepath.WalkFunc, opts WalkOptions) error {
+	maxConcurrency := len(c.hosts) * c.config.ConnectionsPerHost
+	if opts.Concurrency <= 0 || opts.Concurrency > maxConcurrency {
+		opts.Concurrency = maxConcurrency
+	}
+
+	w := &walker{
+		client:  c,
+		fn:      fn,
+		opts:    opts,
+		queue:   []string{root},
+		pending: 1,
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+
+	wg.Wait()
+
+	return w.err
+}
+
+type walker struct {
+	client *Client
+	fn     filepath.WalkFunc
+	opts   WalkOptions
+
+	// serializes calls to fn
+	fnMu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// directories waiting to be listed
+	queue []string
+
+	// number of directories queued or being listed
+	pending int
+
+	// first error returned by fn
+	err error
+}
+
+func (w *walker) work() {
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && w.pending > 0 && w.err == nil {
+			w.cond.Wait()
+		}
+
+		if w.pending == 0 || w.err != nil {
+			w.mu.Unlock()
+			return
+		}
+
+		dir := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		w.mu.Unlock()
+
+		subdirs, err := w.walkDir(dir)
+
+		w.mu.Lock()
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		w.queue = append(w.queue, subdirs...)
+		w.pending += len(subdirs) - 1
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+func (w *walker) call(fullPath string, info os.FileInfo, err error) error {
+	w.fnMu.Lock()
+	defer w.fnMu.Unlock()
+	return w.fn(fullPath, info, err)
+}
+
+// List dir, calling fn for each entry, and return the subdirectories that
+// should be walked.
+func (w *walker) walkDir(dir string) ([]string, error) {
+	entries, err := w.client.ReadDir(dir)
+	if err != nil {
+		if err = w.call(dir, nil, err); err == filepath.SkipDir {
+			err = nil
+		}
+		return nil, err
+	}
+
+	var subdirs []string
+	for _, entry := range entries {
+		fullPath := path.Join(dir, entry.Name())
+
+		isDir := entry.IsDir()
+		if entry.Mode()&os.ModeSymlink != 0 {
+			isDir = false
+			if w.opts.FollowSymlinks {
+				if info, err := w.client.Stat(fullPath); err == nil && info.IsDir() {
+					isDir = true
+				}
+			}
+		}
+
+		if err := w.call(fullPath, entry, nil); err != nil {
+			if err != filepath.SkipDir {
+				return nil, err
+			}
+
+			if !isDir {
+				// skip the rest of this directory
+				return subdirs, nil
+			}
+
+			continue
+		}
+
+		if isDir {
+			subdirs = append(subdirs, fullPath)
+		}
+	}
+
+	return subdirs, nil
+}
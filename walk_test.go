@@ -0,0 +1,86 @@
+// Copyright 2015 Muir Manders.  All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package goftp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWalkDir(t *testing.T) {
+	for _, addr := range ftpdAddrs {
+		c, err := DialConfig(goftpConfig, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.RemoveAll("testroot/git-ignored/walk")
+
+		for _, dir := range []string{"walk/a/b", "walk/c", "walk/skipme"} {
+			if err := os.MkdirAll("testroot/git-ignored/"+dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, f := range []string{"walk/foo", "walk/a/b/bar", "walk/skipme/baz"} {
+			if err := ioutil.WriteFile("testroot/git-ignored/"+f, []byte{1}, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var got []string
+		err = c.WalkDir("git-ignored/walk", func(fullPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			got = append(got, fullPath)
+
+			if info.Name() == "skipme" {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}, WalkOptions{Concurrency: 2})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(got)
+
+		expected := []string{
+			"git-ignored/walk/a",
+			"git-ignored/walk/a/b",
+			"git-ignored/walk/a/b/bar",
+			"git-ignored/walk/c",
+			"git-ignored/walk/foo",
+			"git-ignored/walk/skipme",
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Got %v", got)
+		}
+
+		// errors from fn stop the walk
+		stop := errors.New("stop")
+		err = c.WalkDir("git-ignored/walk", func(fullPath string, info os.FileInfo, err error) error {
+			return stop
+		}, WalkOptions{})
+
+		if err != stop {
+			t.Errorf("Got %v", err)
+		}
+
+		if c.numOpenConns() != len(c.freeConnCh) {
+			t.Error("Leaked a connection")
+		}
+	}
+}